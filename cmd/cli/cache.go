@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/pkg/errors"
+)
+
+// cacheCommand lists cached repositories, or removes one of them by it's key, or all of them.
+func cacheCommand(cache *crud.Cache, args []string) error {
+	var op = "cli.cacheCommand"
+
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		printEntries(cache.Entries())
+	case "purge":
+		if len(args) > 1 {
+			if err := cache.Remove(args[1]); err != nil {
+				return errors.Wrapf(err, "(%s): removing a cached repository", op)
+			}
+			fmt.Printf("removed %s\n", args[1])
+			return nil
+		}
+
+		removed, err := cache.Purge()
+		if err != nil {
+			return errors.Wrapf(err, "(%s): purging cache", op)
+		}
+		printEntries(removed)
+		fmt.Printf("removed %d repositories\n", len(removed))
+	default:
+		return errors.Errorf("(%s): unknown cache command %q, must be list or purge", op, args[0])
+	}
+
+	return nil
+}
+
+// printEntries prints cached repositories as a table.
+func printEntries(entries []crud.CacheEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "KEY\tURL\tMODE\tREF\tSIZE\tLAST USED\tLAST FETCHED")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", e.Key, e.URL, e.Mode, e.Ref, e.Size,
+			e.LastUsed.Format("2006-01-02 15:04:05"), e.LastFetched.Format("2006-01-02 15:04:05"))
+	}
+}
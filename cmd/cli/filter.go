@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/pkg/errors"
+)
+
+// Exit codes of filtering, 2 is used for wrong arguments.
+const (
+	exitPass = 0 // no policy denied a file
+	exitFail = 1 // a policy denied a file, or warned about it with -fail-on-warn
+)
+
+// filterCommand filters files of a collection with rules from a file, prints a verdict of each file
+// and messages of policies, and returns an exit code of the process.
+func filterCommand(cache *crud.Cache, coll *crud.GitCollection, path string) (int, error) {
+	var op = "cli.filterCommand"
+
+	conf, err := crud.ReadFilterConfig(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "(%s): reading filter rules", op)
+	}
+
+	opts := conf.Options()
+	if *namespace != "" {
+		opts.Namespace = *namespace
+	}
+	if opts.Policies, err = policyChain(cache); err != nil {
+		return 0, errors.Wrapf(err, "(%s): parsing policy sources", op)
+	}
+
+	filtered, err := coll.FilterContext(context.Background(), conf.Config, opts)
+	if err != nil {
+		return 0, errors.Wrapf(err, "(%s): filtering files", op)
+	}
+
+	for _, f := range filtered.Coll {
+		if f.Status != "" {
+			fmt.Printf("%-4s\t%s (%s)\n", "skip", f.Name, f.Status)
+			continue
+		}
+		fmt.Printf("%-4s\t%s\n", f.Verdict, f.Name)
+
+		for _, res := range f.Results {
+			if res.Policy != nil {
+				fmt.Printf("\t%s policy: %s %s@%s\n", res.Rule, res.Policy.Step, res.Policy.Source, res.Policy.Version)
+			}
+		}
+
+		for _, finding := range f.Findings {
+			fmt.Printf("\t%s: %s (%s)\n", finding.Severity, finding.Message, finding.Rule)
+			if finding.Resource != "" {
+				fmt.Printf("\t\tresource: %s\n", finding.Resource)
+			}
+			if finding.Remediation != "" {
+				fmt.Printf("\t\tremediation: %s\n", finding.Remediation)
+			}
+		}
+	}
+	fmt.Printf("%d files, verdict: %s\n", filtered.ConfigFileCount, filtered.Verdict)
+
+	if filtered.Verdict == crud.VerdictFail || (filtered.Verdict == crud.VerdictWarn && *failOnWarn) {
+		return exitFail, nil
+	}
+
+	return exitPass, nil
+}
+
+// policyChain returns where policies are loaded from by flags, policies of rules can be paths on disk,
+// git sources are cloned like scanned repositories.
+func policyChain(cache *crud.Cache) (*crud.PolicyChain, error) {
+	chain := &crud.PolicyChain{LocalRules: true}
+
+	var err error
+	if *orgPolicy != "" {
+		if chain.Org, err = crud.ParsePolicySource(*orgPolicy); err != nil {
+			return nil, err
+		}
+	}
+	if *basePolicy != "" {
+		if chain.Default, err = crud.ParsePolicySource(*basePolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	chain.Git.Clone = crud.CloneStrategy{Mode: crud.CloneMode(*cloneMode), Depth: *depth}
+	if chain.Git.Fetch, err = crud.ParseFetchPolicy(*fetch); err != nil {
+		return nil, err
+	}
+	chain.Git.Cache = cache
+
+	return chain, nil
+}
@@ -1,66 +1,131 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"strings"
 
-	"github.com/pkg/errors"
-	"gopkg.in/src-d/go-git.v4/plumbing"
-
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
-
-	git "gopkg.in/src-d/go-git.v4"
+	"github.com/bejaneps/go-git-webapp/internal/crud"
 )
 
 // example freelancer: micronaut-projects/micronaut-examples/9669e10633ec7bf81488952d015bf36e900f8bca/hello-world-java
 // example arg: https://github.com/micronaut-projects/micronaut-examples 9669e10633ec7bf81488952d015bf36e900f8bca hello-world-java
 
+var (
+	cloneMode = flag.String("clone", string(crud.CloneMemory), "clone mode: full, bare, shallow, single-branch or memory, repositories aren't cached on disk in memory mode")
+	depth     = flag.Int("depth", 0, "count of commits in a shallow clone, memory clones are shallow too if it's set")
+	fetch     = flag.String("fetch", "", "when a cached repository is fetched: always, never or a duration, e.g: 30m")
+	cacheDir  = flag.String("cache-dir", "repositories", "directory repositories are cached in")
+	local     = flag.Bool("local", false, "scan a local repository at url path without cloning it")
+	exclude   = flag.String("exclude", "", "comma separated directories that are skipped")
+	source    = flag.String("source", string(crud.SourceCommit), "files of a local repository that are scanned: commit, index or worktree")
+	workers   = flag.Int("workers", 0, "count of goroutines that index files, count of CPUs if it's 0, 1 indexes files serially")
+	maxBlob   = flag.Int64("max-blob-size", crud.DefaultMaxBlobSize, "size of the largest file which content is read in bytes, negative means no limit")
+
+	filterRules = flag.String("filter", "", "json, yaml or toml file with filter rules, files are filtered and their policies are applied if it's set, exit code is 1 if a policy denies a file")
+	namespace   = flag.String("namespace", "", "package of policies deny, warn and violation rules are evaluated in, overrides one of filter rules, main by default")
+	failOnWarn  = flag.Bool("fail-on-warn", false, "exit code is 1 if a policy warns about a file too")
+	policyDir   = flag.String("policy-dir", crud.DefaultPolicyDir, "directory of a repository rego modules and data documents of a policy are loaded from")
+	orgPolicy   = flag.String("org-policy", "", "policy used if a repository doesn't have one: a url, a path or a git source, e.g: git::https://github.com/org/policies//k8s?ref=v1.2.0")
+	basePolicy  = flag.String("default-policy", "", "policy used if neither a repository nor -org-policy has one, a built in policy that doesn't deny anything if it's empty")
+)
+
 func main() {
-	// check if args are empty
-	if len(os.Args) < 1 || len(os.Args) != 4 {
-		log.Fatalf("usage: .%s url commit_hash directory", os.Args[0])
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] url [revision [directories]]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -local [-source commit|index|worktree] [flags] path [revision [directories]]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] cache list|purge [key]\n", os.Args[0])
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	url := os.Args[1]
-	hash := os.Args[2]
-	dir := os.Args[3]
-
-	// initialize vars, so we don't recreate them
-	r := &git.Repository{}
-	var err error
+	// check if args are empty
+	if flag.NArg() < 1 || flag.NArg() > 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	// clone a repo, cleanups directory name filepath.Clean() implicitly
-	r, err = git.PlainClone(url, false, &git.CloneOptions{
-		URL: url,
-	})
-	if errors.Cause(err) == git.ErrRepositoryAlreadyExists { // check if repo exists, then just open it
-		r, err = git.PlainOpen(url)
-		if err != nil {
+	cache := crud.NewCache(*cacheDir, crud.CacheLimits{})
+	if flag.Arg(0) == "cache" {
+		if err := cacheCommand(cache, flag.Args()[1:]); err != nil {
 			log.Fatalf("[ERROR]: %v", err)
 		}
-	} else if err != nil {
-		log.Fatalf("[ERROR]: %v", err)
+		return
 	}
 
-	// retrieve a commit
-	commit, err := r.CommitObject(plumbing.NewHash(hash))
+	url := flag.Arg(0)
+	hash := flag.Arg(1)
+	dir := flag.Arg(2)
+
+	coll, err := collect(cache, url, hash, dir)
 	if err != nil {
 		log.Fatalf("[ERROR]: %v", err)
 	}
+	defer coll.Close()
 
-	tree, err := commit.Tree()
-	if err != nil {
-		log.Fatalf("[ERROR]: %v", err)
+	if *filterRules != "" {
+		code, err := filterCommand(cache, coll, *filterRules)
+		coll.Close()
+		if err != nil {
+			log.Fatalf("[ERROR]: %v", err)
+		}
+		os.Exit(code)
 	}
 
 	// print just files in a given directory
-	tree.Files().ForEach(func(f *object.File) error {
-		if strings.Contains(f.Name, dir) {
-			name := f.Name[strings.Index(f.Name, "/")+1:]
-			fmt.Printf("Hash: %s\t File: %s\n", f.Hash, name)
+	fmt.Printf("Commit: %s\n", coll.BaseHash)
+	if coll.Source != "" && coll.Source != crud.SourceCommit {
+		fmt.Printf("Source: %s\n", coll.Source)
+	}
+	for _, f := range coll.Coll {
+		if f.Status != "" {
+			fmt.Printf("Hash: %s\t File: %s (%s)\n", f.Hash, f.Name, f.Status)
+			continue
 		}
-		return nil
+		fmt.Printf("Hash: %s\t File: %s\n", f.Hash, f.Name)
+	}
+}
+
+// collect returns files of a local repository if -local flag is set, otherwise it clones a repository.
+func collect(cache *crud.Cache, url, hash, dir string) (*crud.GitCollection, error) {
+	if *local {
+		src, err := crud.ParseSourceMode(*source)
+		if err != nil {
+			return nil, err
+		}
+
+		return crud.GetLocalCollectionContext(context.Background(), url, hash, "", &crud.Options{
+			Source:  src,
+			Include: crud.SplitDirs(dir),
+			Exclude: crud.SplitDirs(*exclude),
+
+			MaxBlobSize: *maxBlob,
+			Workers:     *workers,
+			PolicyDir:   *policyDir,
+		})
+	}
+
+	clone := crud.CloneStrategy{Mode: crud.CloneMode(*cloneMode), Depth: *depth}
+	if err := clone.Validate(); err != nil {
+		return nil, err
+	}
+
+	policy, err := crud.ParseFetchPolicy(*fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	return crud.GetGitCollectionContext(context.Background(), url, hash, "", &crud.Options{
+		Clone:   clone,
+		Fetch:   policy,
+		Cache:   cache,
+		Include: crud.SplitDirs(dir),
+		Exclude: crud.SplitDirs(*exclude),
+
+		MaxBlobSize: *maxBlob,
+		Workers:     *workers,
+		PolicyDir:   *policyDir,
 	})
 }
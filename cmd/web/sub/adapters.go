@@ -2,13 +2,28 @@ package sub
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
 	"runtime/debug"
 
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// opRegexp matches the names of operations that wrapped an error, e.g: (crud.GetGitCollection): cloning a git repo
+var opRegexp = regexp.MustCompile(`\(([\w.]+)\): `)
+
+// apiError is a json representation of an error returned by api handlers.
+type apiError struct {
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Op      []string `json:"op,omitempty"` // operations that wrapped an error, outermost first
+
+	Errors crud.ConfigErrors `json:"errors,omitempty"` // errors of an invalid filter config with their positions
+}
+
 // displayError is a function that uses usual respond for errors that happen on server side.
 func (e *env) displayError(w http.ResponseWriter, err error, status int) {
 	w.WriteHeader(status)
@@ -18,6 +33,24 @@ func (e *env) displayError(w http.ResponseWriter, err error, status int) {
 	e.render(w, "error.page.tmpl", http.StatusText(http.StatusInternalServerError))
 }
 
+// displayJSONError is the same as displayError, but responds with a json error for api clients.
+func (e *env) displayJSONError(w http.ResponseWriter, err error, status int) {
+	log.Error(err)
+
+	resp := apiError{
+		Status:  status,
+		Message: err.Error(),
+	}
+	for _, m := range opRegexp.FindAllStringSubmatch(resp.Message, -1) {
+		resp.Op = append(resp.Op, m[1])
+	}
+	if errs, ok := errors.Cause(err).(crud.ConfigErrors); ok {
+		resp.Errors = errs
+	}
+
+	e.renderJSON(w, map[string]apiError{"error": resp}, status)
+}
+
 // catchPanic is an adapter for catching panic.
 func (e *env) catchPanic(f http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -33,6 +66,21 @@ func (e *env) catchPanic(f http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// catchPanicJSON is the same as catchPanic, but responds with a json error, it's used by api routes.
+func (e *env) catchPanicJSON(f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Error(string(debug.Stack()))
+
+				e.displayJSONError(w, fmt.Errorf("%v", rec), http.StatusInternalServerError)
+			}
+		}()
+
+		f.ServeHTTP(w, r)
+	})
+}
+
 // render renders a template from a cache.
 func (e *env) render(w http.ResponseWriter, name string, td interface{}) {
 	// Retrieve the appropriate template set from the cache based on the page n
@@ -61,3 +109,18 @@ func (e *env) render(w http.ResponseWriter, name string, td interface{}) {
 	// takes an io.Writer.
 	buf.WriteTo(w)
 }
+
+// renderJSON encodes v to json and writes it with a status code.
+func (e *env) renderJSON(w http.ResponseWriter, v interface{}, status int) {
+	// encode to a buffer first, so a failed encoding doesn't leave a half written response
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,116 @@
+package sub
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errAdminDisabled = errors.New("admin api is disabled, admin_token isn't set in server config")
+	errAdminToken    = errors.New("invalid admin token")
+)
+
+// apiCache is a json representation of a repository cache.
+type apiCache struct {
+	Dir     string            `json:"dir"`
+	Size    int64             `json:"size"` // total size of cached repositories in bytes
+	Count   int               `json:"count"`
+	Repos   []crud.CacheEntry `json:"repositories"`
+	Removed []crud.CacheEntry `json:"removed,omitempty"` // repositories removed by a request
+}
+
+// newAPICache converts cache entries to their json representation.
+func newAPICache(dir string, entries, removed []crud.CacheEntry) apiCache {
+	resp := apiCache{
+		Dir:     dir,
+		Count:   len(entries),
+		Repos:   entries,
+		Removed: removed,
+	}
+	for _, entry := range entries {
+		resp.Size += entry.Size
+	}
+
+	return resp
+}
+
+// requireAdmin is an adapter that only calls f if a request has a bearer token
+// that matches admin_token of server config.
+func (e *env) requireAdmin(f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.config.AdminToken == "" {
+			e.displayJSONError(w, errAdminDisabled, http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(e.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			e.displayJSONError(w, errAdminToken, http.StatusUnauthorized)
+			return
+		}
+
+		f.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminCache returns all cached repositories.
+func (e *env) handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	e.renderJSON(w, newAPICache(e.cache.Dir(), e.cache.Entries(), nil), http.StatusOK)
+}
+
+// handleAdminCachePurge removes all cached repositories that aren't being scanned.
+func (e *env) handleAdminCachePurge(w http.ResponseWriter, r *http.Request) {
+	var op = "cmd.handleAdminCachePurge"
+
+	removed, err := e.cache.Purge()
+	if err != nil {
+		e.displayJSONError(w, errors.Wrapf(err, "(%s): purging cache", op), http.StatusInternalServerError)
+		return
+	}
+
+	e.renderJSON(w, newAPICache(e.cache.Dir(), e.cache.Entries(), removed), http.StatusOK)
+}
+
+// handleAdminCacheRemove removes a single cached repository.
+func (e *env) handleAdminCacheRemove(w http.ResponseWriter, r *http.Request) {
+	err := e.cache.Remove(mux.Vars(r)["key"])
+	switch errors.Cause(err) {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case crud.ErrCacheEntryNotFound:
+		e.displayJSONError(w, err, http.StatusNotFound)
+	case crud.ErrCacheEntryInUse:
+		e.displayJSONError(w, err, http.StatusConflict)
+	default:
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+	}
+}
+
+// collectCache periodically evicts unused repositories until done is closed.
+func (e *env) collectCache(done <-chan struct{}) {
+	ticker := time.NewTicker(collectPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := e.cache.Evict()
+			if err != nil {
+				log.Error(err)
+			}
+			for _, entry := range removed {
+				log.Infof("evicted cached repository %s (%s)", entry.URL, entry.Key)
+			}
+		case <-done:
+			return
+		}
+	}
+}
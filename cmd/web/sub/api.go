@@ -0,0 +1,380 @@
+package sub
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// openAPIFile is an OpenAPI document that describes /api/v1 routes.
+const openAPIFile = "./api/openapi.json"
+
+// maxFilterConfigSize is a size of the largest filter config api accepts.
+const maxFilterConfigSize = 1 << 20
+
+// apiScan is a json representation of a scan.
+type apiScan struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Hash    string    `json:"hash"`
+	Dir     string    `json:"dir"`
+	Created time.Time `json:"created"`
+
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+
+	Commit      interface{} `json:"commit"`
+	LastFetched time.Time   `json:"last_fetched"`
+	FileCount   int         `json:"file_count"`
+	Language    interface{} `json:"language"`
+	Filtered    bool        `json:"filtered"`
+
+	RepoFilter      *crud.FilterConfig `json:"repo_filter,omitempty"`       // rules of a repository, e.g: .gitfilter.yaml
+	RepoFilterName  string             `json:"repo_filter_name,omitempty"`  // name of a file rules are read from
+	RepoFilterError string             `json:"repo_filter_error,omitempty"` // set instead of rules if they are invalid
+}
+
+// apiFile is a json representation of a single file in a scan.
+type apiFile struct {
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	URL       string `json:"url"`
+	Extension string `json:"extension"`
+	Size      int64  `json:"size"`
+	Mode      string `json:"mode"`
+	Status    string `json:"status,omitempty"` // e.g: skipped: too large, content of a file wasn't read
+
+	Attributes []string `json:"attributes,omitempty"` // e.g: binary, vendored
+}
+
+// apiResult is a json representation of a file that passed a filter and the policy applied on it.
+type apiResult struct {
+	apiFile
+
+	Type     string          `json:"type"`     // name of the first rule a file matched
+	Rules    []string        `json:"rules"`    // names of all rules a file matched, in order of a config
+	Results  []apiRuleResult `json:"results"`  // policy of each rule and it's verdict
+	Verdict  string          `json:"verdict"`  // the worst verdict of results: pass, warn or fail
+	Findings []crud.Finding  `json:"findings"` // findings of policies of all rules
+}
+
+// apiRuleResult is a json representation of a policy a rule applied on a file.
+type apiRuleResult struct {
+	crud.RuleResult
+
+	Raw interface{} `json:"raw,omitempty"` // a rego result set, only if it's asked for by raw query parameter
+}
+
+// apiResults is a json representation of a filter result.
+type apiResults struct {
+	ScanID          string      `json:"scan_id"`
+	ConfigFileCount int         `json:"config_file_count"`
+	Verdict         string      `json:"verdict"` // the worst verdict of files
+	Files           []apiResult `json:"files"`
+}
+
+// newAPIScan converts a scan to it's json representation.
+func newAPIScan(sc *scan) apiScan {
+	files := sc.Files()
+
+	return apiScan{
+		ID:          sc.ID,
+		URL:         files.BaseURL,
+		Hash:        files.BaseHash,
+		Dir:         files.BaseDir,
+		Created:     sc.Created,
+		Include:     files.Include,
+		Exclude:     files.Exclude,
+		Commit:      files.Commit,
+		LastFetched: files.LastFetched,
+		FileCount:   files.FileCount,
+		Language:    files.Language,
+		Filtered:    sc.Configs() != nil,
+
+		RepoFilter:      files.RepoFilter,
+		RepoFilterName:  files.RepoFilterName,
+		RepoFilterError: files.RepoFilterError,
+	}
+}
+
+// newAPIResults converts a filtered collection to it's json representation,
+// rego result sets of policies are included if raw is true.
+func newAPIResults(id string, coll *crud.GitCollection, raw bool) apiResults {
+	res := apiResults{
+		ScanID:          id,
+		ConfigFileCount: coll.ConfigFileCount,
+		Verdict:         coll.Verdict,
+		Files:           make([]apiResult, 0, len(coll.Coll)),
+	}
+	for _, f := range coll.Coll {
+		results := make([]apiRuleResult, len(f.Results))
+		for i, r := range f.Results {
+			results[i] = apiRuleResult{RuleResult: r}
+			if raw {
+				results[i].Raw = r.Raw
+			}
+		}
+
+		res.Files = append(res.Files, apiResult{
+			apiFile: apiFile{
+				Name:      f.Name,
+				Hash:      f.Hash,
+				URL:       f.URL,
+				Extension: f.Extension,
+				Size:      f.Size,
+				Mode:      f.Mode,
+				Status:    f.Status,
+
+				Attributes: f.Attributes,
+			},
+			Type:     f.Type,
+			Rules:    f.Rules,
+			Results:  results,
+			Verdict:  f.Verdict,
+			Findings: f.Findings,
+		})
+	}
+
+	return res
+}
+
+// apiScanFromRequest returns a scan of a caller's session from id route variable, it responds with an error
+// if a session doesn't have such scan.
+func (e *env) apiScanFromRequest(w http.ResponseWriter, r *http.Request) (*scan, bool) {
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	sc, err := e.sessions.scan(sess, mux.Vars(r)["id"])
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusNotFound)
+		return nil, false
+	}
+
+	return sc, true
+}
+
+// handleAPIScanCreate starts a job that clones a repository and saves it as a new scan.
+func (e *env) handleAPIScanCreate(w http.ResponseWriter, r *http.Request) {
+	var op = "cmd.handleAPIScanCreate"
+
+	req := &scanRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		e.displayJSONError(w, errors.Wrapf(err, "(%s): decoding request body", op), http.StatusBadRequest)
+		return
+	} else if req.URL == "" {
+		e.displayJSONError(w, errors.Errorf("(%s): url is required", op), http.StatusBadRequest)
+		return
+	} else if err := req.Auth.ValidateUntrusted(); err != nil {
+		e.displayJSONError(w, errors.Wrapf(err, "(%s): invalid auth", op), http.StatusBadRequest)
+		return
+	}
+
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	e.submitAPIJob(w, sess, jobScan, e.scanJob(sess, req))
+}
+
+// submitAPIJob starts a job of a session and responds with it's status.
+func (e *env) submitAPIJob(w http.ResponseWriter, sess *session, kind jobKind, run jobFunc) {
+	j, err := e.jobs.submit(sess.id, kind, run)
+	if err == errQueueFull {
+		e.displayJSONError(w, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/jobs/"+j.id)
+	e.renderJSON(w, j.status(), http.StatusAccepted)
+}
+
+// handleAPIScan returns a summary of a scan.
+func (e *env) handleAPIScan(w http.ResponseWriter, r *http.Request) {
+	sc, ok := e.apiScanFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	e.renderJSON(w, newAPIScan(sc), http.StatusOK)
+}
+
+// handleAPIScanFiles returns a list of all files in a scan, or only ones that have attributes
+// from attribute query parameters, e.g: ?attribute=configuration&attribute=!vendored.
+func (e *env) handleAPIScanFiles(w http.ResponseWriter, r *http.Request) {
+	sc, ok := e.apiScanFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	files, err := sc.Files().WithAttributes(r.URL.Query()["attribute"])
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	resp := make([]apiFile, 0, len(files.Coll))
+	for _, f := range files.Coll {
+		resp = append(resp, apiFile{
+			Name:      f.Name,
+			Hash:      f.Hash,
+			URL:       f.URL,
+			Extension: f.Extension,
+			Size:      f.Size,
+			Mode:      f.Mode,
+			Status:    f.Status,
+
+			Attributes: f.Attributes,
+		})
+	}
+
+	e.renderJSON(w, resp, http.StatusOK)
+}
+
+// handleAPIScanLanguages returns language statistics of a scan.
+func (e *env) handleAPIScanLanguages(w http.ResponseWriter, r *http.Request) {
+	sc, ok := e.apiScanFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	e.renderJSON(w, sc.Files().Language, http.StatusOK)
+}
+
+// handleAPIScanFilter starts a job that applies a filter config to a scan, policy results can be
+// retrieved from handleAPIScanResults when job is done.
+func (e *env) handleAPIScanFilter(w http.ResponseWriter, r *http.Request) {
+	var op = "cmd.handleAPIScanFilter"
+
+	sc, ok := e.apiScanFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// rules can be in json, yaml or toml, it's told by a content type
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFilterConfigSize))
+	if err != nil {
+		e.displayJSONError(w, errors.Wrapf(err, "(%s): reading request body", op), http.StatusBadRequest)
+		return
+	}
+
+	// an empty body means default rules, they are checked before a job starts
+	var conf *crud.FilterConfig
+	if len(bytes.TrimSpace(body)) == 0 {
+		if _, err = e.defaultFilter(sc); err != nil {
+			e.displayJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+	} else {
+		conf, err = crud.ParseFilterConfig(body, crud.DetectFormat("", r.Header.Get("Content-Type"), body))
+		if _, ok := err.(crud.ConfigErrors); ok {
+			e.displayJSONError(w, errors.Wrapf(err, "(%s): invalid filter config", op), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			e.displayJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	e.submitAPIJob(w, sess, jobFilter, e.filterJob(sc, conf))
+}
+
+// handleAPIScanResults returns the policy results of the last filter applied to a scan.
+func (e *env) handleAPIScanResults(w http.ResponseWriter, r *http.Request) {
+	var op = "cmd.handleAPIScanResults"
+
+	sc, ok := e.apiScanFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	coll := sc.Configs()
+	if coll == nil {
+		e.displayJSONError(w, errors.Errorf("(%s): scan wasn't filtered yet", op), http.StatusNotFound)
+		return
+	}
+
+	raw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+	e.renderJSON(w, newAPIResults(sc.ID, coll, raw), http.StatusOK)
+}
+
+// handleAPIJob returns a status of a job of a caller's session.
+func (e *env) handleAPIJob(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	j, err := e.jobs.get(sess.id, mux.Vars(r)["id"])
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusNotFound)
+		return
+	}
+
+	e.renderJSON(w, j.status(), http.StatusOK)
+}
+
+// handleAPIJobCancel cancels a job of a caller's session.
+func (e *env) handleAPIJobCancel(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = e.jobs.cancel(sess.id, id)
+	if err == errJobNotFound {
+		e.displayJSONError(w, err, http.StatusNotFound)
+		return
+	} else if err == errJobFinished {
+		e.displayJSONError(w, err, http.StatusConflict)
+		return
+	}
+
+	j, err := e.jobs.get(sess.id, id)
+	if err != nil {
+		e.displayJSONError(w, err, http.StatusNotFound)
+		return
+	}
+
+	e.renderJSON(w, j.status(), http.StatusAccepted)
+}
+
+// handleAPIDocs serves an OpenAPI document of the api.
+func (e *env) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, openAPIFile)
+}
+
+// handleAPITypes returns built-in file types filter rules can use by name.
+func (e *env) handleAPITypes(w http.ResponseWriter, r *http.Request) {
+	e.renderJSON(w, crud.FileTypes(), http.StatusOK)
+}
+
+// handleAPIFilterSchema returns a json schema filter configs are validated against.
+func (e *env) handleAPIFilterSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write([]byte(crud.FilterSchema))
+}
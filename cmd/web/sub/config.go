@@ -0,0 +1,180 @@
+package sub
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/pkg/errors"
+)
+
+// defaultConfigFile is read if CONFIG environment variable isn't set, it's optional.
+const defaultConfigFile = "config/server.json"
+
+var configFile = os.Getenv("CONFIG")
+
+// serverConfig holds settings of a server that are read from a json file.
+type serverConfig struct {
+	// Hosts holds credentials used for cloning private repositories on each host, repositories of api requests
+	// are only cloned with ones that list them, credentials in api requests take precedence over them.
+	Hosts crud.HostCredentials `json:"hosts"`
+
+	// Fetch tells when cached repositories are fetched before scanning: always, never or a duration,
+	// e.g: 30m means if they were fetched longer than 30 minutes ago. It can be overridden by api requests.
+	Fetch crud.FetchPolicy `json:"fetch"`
+
+	// Clone tells how repositories are cloned: full, bare, shallow, single-branch or memory,
+	// shallow clones keep only depth last commits. It can be overridden by api requests.
+	Clone crud.CloneStrategy `json:"clone"`
+
+	// Cache tells where cloned repositories are kept and when they are evicted.
+	Cache cacheConfig `json:"cache"`
+
+	// MaxBlobSize is a size of the largest file which content is read, e.g: 512KB, 1MB by default.
+	// Larger files are listed in scans, but they are reported as too large instead of being filtered.
+	MaxBlobSize string `json:"max_blob_size"`
+	maxBlobSize int64
+
+	// Workers is a count of goroutines each scan reads and classifies files with, count of CPUs by default.
+	Workers int `json:"workers"`
+
+	// PolicyDir is a directory of scanned repositories their policy modules and data are loaded from,
+	// policy by default. It can be overridden by api requests.
+	PolicyDir string `json:"policy_dir"`
+
+	// Policies tells where policies of rules are loaded from, if neither a rule nor a scanned repository has one.
+	Policies policiesConfig `json:"policies"`
+
+	// AdminToken is a bearer token of /api/v1/admin routes, they are disabled if it's empty.
+	AdminToken string `json:"admin_token"`
+
+	// Filter holds baseline filter rules, they are used when a user doesn't give rules,
+	// combined with rules of a scanned repository.
+	Filter filterConfig `json:"filter"`
+}
+
+// filterConfig holds default filter rules of a server.
+type filterConfig struct {
+	Baseline string `json:"baseline"` // path of a json, yaml or toml file with rules, optional
+	Mode     string `json:"mode"`     // how rules of a repository are combined with baseline ones: merge, repo or baseline
+	baseline *crud.FilterConfig
+}
+
+// policiesConfig holds policy sources of a server, each of them is a url, a path or a git source,
+// e.g: git::https://github.com/org/policies//k8s?ref=v1.2.0.
+type policiesConfig struct {
+	Org     *crud.PolicySource `json:"org"`     // an organization policy, optional
+	Default *crud.PolicySource `json:"default"` // a built in policy if it isn't set
+	Timeout string             `json:"timeout"` // how long retrieving a policy from a url can take, e.g: 10s, 30s by default
+}
+
+// cacheConfig holds settings of a repository cache.
+type cacheConfig struct {
+	Dir     string `json:"dir"`      // repositories by default
+	MaxSize string `json:"max_size"` // total size of cached repositories, e.g: 10GB, unlimited if empty
+	MaxAge  string `json:"max_age"`  // repositories that weren't used longer than it are evicted, e.g: 168h
+}
+
+// newCache returns a repository cache according to config.
+func (c cacheConfig) newCache() (*crud.Cache, error) {
+	var op = "cmd.newCache"
+	var limits crud.CacheLimits
+	var err error
+
+	if c.MaxSize != "" {
+		limits.MaxSize, err = parseSize(c.MaxSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): parsing max_size", op)
+		}
+	}
+
+	if c.MaxAge != "" {
+		limits.MaxAge, err = time.ParseDuration(c.MaxAge)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): parsing max_age", op)
+		}
+	}
+
+	return crud.NewCache(c.Dir, limits), nil
+}
+
+// sizeUnits maps a suffix of a size to a count of bytes it means.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes, e.g: 1024, 512MB or 10GB.
+func parseSize(s string) (int64, error) {
+	var op = "cmd.parseSize"
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("(%s): invalid size %q, must be a count of bytes, KB, MB, GB or TB", op, s)
+	}
+
+	return int64(n * float64(unit)), nil
+}
+
+// loadConfig reads a server config from a file in CONFIG environment variable,
+// if it isn't set, config/server.json is read if it exists.
+func loadConfig() (*serverConfig, error) {
+	var op = "cmd.loadConfig"
+
+	conf := &serverConfig{}
+
+	path := configFile
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); os.IsNotExist(err) {
+			return conf, nil
+		}
+		path = defaultConfigFile
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): opening config file", op)
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(conf); err != nil {
+		return nil, errors.Wrapf(err, "(%s): decoding config file %s", op, path)
+	}
+
+	if conf.MaxBlobSize != "" {
+		conf.maxBlobSize, err = parseSize(conf.MaxBlobSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): parsing max_blob_size", op)
+		}
+	}
+
+	if err = crud.ValidateMergeMode(conf.Filter.Mode); err != nil {
+		return nil, errors.Wrapf(err, "(%s): parsing filter mode", op)
+	}
+	if conf.Filter.Baseline != "" {
+		conf.Filter.baseline, err = crud.ReadFilterConfig(conf.Filter.Baseline)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): reading baseline filter rules", op)
+		}
+	}
+
+	return conf, nil
+}
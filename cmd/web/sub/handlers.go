@@ -1,126 +1,204 @@
 package sub
 
 import (
-	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
-	"strings"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 
 	jsoniter "github.com/json-iterator/go"
 )
 
-// request is a struct that holds a json config from filter page in web app
-type request struct {
-	Config []crud.Config `json:"config"`
-}
-
 var (
 	json = jsoniter.ConfigCompatibleWithStandardLibrary
 )
 
 // handleRegexpGET handles upcoming requests from webapp filter page,
-// when posting a json form not file.
+// when posting rules in a form, not file. Format field tells if they are json, yaml or toml,
+// it's detected by content if it's empty.
 func (e *env) handleRegexpGET(w http.ResponseWriter, r *http.Request) {
-	// check if user searched a repository or no
-	if e.gitCollectionFiles == nil {
-		http.Redirect(w, r, "/search", http.StatusTemporaryRedirect)
+	if r.FormValue("default") != "" { // rules of a repository and baseline rules of a server
+		e.filterAndDownload(w, r, nil, "")
 		return
 	}
 
-	pattern := r.FormValue("pattern") // get the json from request
+	pattern := []byte(r.FormValue("pattern")) // get the rules from request
 
-	var err error
+	format := r.FormValue("format")
+	if format == "" {
+		format = crud.DetectFormat("", "", pattern)
+	}
 
-	// convert all backslashes to forward slashes in string
-	pattern = strings.ReplaceAll(pattern, "\\", "\\\\")
+	e.filterAndDownload(w, r, pattern, format)
+}
 
-	// decode query value to json
-	conf := &request{}
-	err = json.NewDecoder(strings.NewReader(pattern)).Decode(&conf)
+// handleRegexpPOST handles upcoming requests from webapp filter page,
+// when posting a json, yaml or toml file, not form. Format is detected by an extension of a file.
+func (e *env) handleRegexpPOST(w http.ResponseWriter, r *http.Request) {
+	// get a file from request
+	file, header, err := r.FormFile("pattern")
 	if err != nil {
-		e.displayError(w, err, http.StatusInternalServerError)
+		e.displayError(w, err, http.StatusBadRequest)
 		return
 	}
+	defer file.Close()
 
-	// filter files by regexp
-	coll, err := e.gitCollectionFiles.Filter(conf.Config)
+	pattern, err := ioutil.ReadAll(file)
 	if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
+	} else if len(pattern) == 0 {
+		e.displayError(w, errors.New("filter rules file is empty"), http.StatusBadRequest)
+		return
 	}
 
-	e.gitCollectionConfigs = coll // save to cache
+	format := crud.DetectFormat(header.Filename, header.Header.Get("Content-Type"), pattern)
 
-	// write in json file also the file count in repo and count of programming langs used
-	coll.FileCount = e.gitCollectionFiles.FileCount
-	coll.Language = e.gitCollectionFiles.Language
+	e.filterAndDownload(w, r, pattern, format)
+}
 
-	// create a json file
-	f, err := coll.ToJSONFile()
+// filterAndDownload starts a job that filters files of a current scan by rules in a format, and saves
+// the result to session, user is redirected to a page of the job, it links to a json file of the result
+// when it's done. Rules of a repository and baseline rules of a server are used if pattern is nil.
+func (e *env) filterAndDownload(w http.ResponseWriter, r *http.Request, pattern []byte, format string) {
+	// check if user searched a repository or no
+	sess, err := e.session(w, r)
 	if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
-
-	// create a download link for json file
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", f.Name()))
-	w.Header().Set("Content-Type", "application/json")
-	http.ServeContent(w, r, f.Name(), time.Now(), f)
-}
-
-// handleRegexpPOST handles upcoming requests from webapp filter page,
-// when posting a json file, not form.
-func (e *env) handleRegexpPOST(w http.ResponseWriter, r *http.Request) {
-	// check if user searched a repository or no
-	if e.gitCollectionFiles == nil {
+	sc := sess.Current()
+	if sc == nil {
 		http.Redirect(w, r, "/search", http.StatusTemporaryRedirect)
 		return
 	}
 
-	// get json file from request
-	file, _, err := r.FormFile("pattern")
-	if err != nil {
+	// decode and validate rules before a job starts, user input is never rewritten,
+	// so escaped regexps stay as they are
+	var conf *crud.FilterConfig
+	if pattern == nil {
+		conf, err = e.defaultFilter(sc)
+	} else {
+		conf, err = crud.ParseFilterConfig(pattern, format)
+	}
+	if _, ok := err.(crud.ConfigErrors); ok || errors.Cause(err) == crud.ErrNoFilterConfig {
+		e.displayError(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// filter files in background, policies can take longer than a write timeout of a server
+	j, err := e.jobs.submit(sess.id, jobFilter, e.filterJob(sc, conf))
+	if err == errQueueFull {
+		e.displayError(w, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	// read a file into a buffer, and then replace all \ to /
-	buf := &strings.Builder{}
-	b, err := io.Copy(buf, file)
+	http.Redirect(w, r, "/jobs/"+j.id, http.StatusFound)
+}
+
+func (e *env) handleSearch(w http.ResponseWriter, r *http.Request) {
+	e.render(w, "create.page.tmpl", nil)
+}
+
+func (e *env) handleSearchQuery(w http.ResponseWriter, r *http.Request) {
+	// parse values from url query, directories are comma separated
+	req := &scanRequest{
+		URL:     r.URL.Query().Get("url"),
+		Ref:     r.URL.Query().Get("commit"),
+		Include: crud.SplitDirs(r.URL.Query().Get("dir")),
+		Exclude: crud.SplitDirs(r.URL.Query().Get("exclude")),
+	}
+
+	sess, err := e.session(w, r)
 	if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
-	} else if b == 0 {
-		e.displayError(w, errors.New("no bytes copied from file to buffer"), http.StatusInternalServerError)
+	}
+
+	// get hash and file collections in background, result is saved to user's session
+	j, err := e.jobs.submit(sess.id, jobScan, e.scanJob(sess, req))
+	if err == errQueueFull {
+		e.displayError(w, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
-	pattern := strings.ReplaceAll(buf.String(), "\\", "\\\\")
 
-	// decode file into json struct
-	conf := &request{}
-	err = json.NewDecoder(strings.NewReader(pattern)).Decode(&conf)
+	http.Redirect(w, r, "/jobs/"+j.id, http.StatusFound)
+}
+
+// handleJob shows a progress of a job of a user's session, when a scan job is done user is redirected to files page,
+// and a page of a done filter job links to it's results.
+func (e *env) handleJob(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
 	if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	// filter files by regexp
-	coll, err := e.gitCollectionFiles.Filter(conf.Config)
+	j, err := e.jobs.get(sess.id, mux.Vars(r)["id"])
+	if err != nil {
+		e.displayError(w, err, http.StatusNotFound)
+		return
+	}
+
+	status := j.status()
+	if status.Done() {
+		// make a scan current, in case user started several searches at once
+		sess.use(status.ScanID)
+
+		if status.Kind == jobScan {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+	}
+
+	e.render(w, "job.page.tmpl", status)
+}
+
+// handleJobResults sends results of a done filter job of a user's session as a json file,
+// they are results of the last filter of a job's scan.
+func (e *env) handleJobResults(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
 	if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	e.gitCollectionConfigs = coll // save to cache
+	j, err := e.jobs.get(sess.id, mux.Vars(r)["id"])
+	if err != nil {
+		e.displayError(w, err, http.StatusNotFound)
+		return
+	}
+	status := j.status()
+	if status.Kind != jobFilter || !status.Done() {
+		e.displayError(w, errors.New("job doesn't have results"), http.StatusNotFound)
+		return
+	}
 
-	// write in json file also the file count in repo and count of programming langs used
-	coll.FileCount = e.gitCollectionFiles.FileCount
-	coll.Language = e.gitCollectionFiles.Language
+	sc, err := e.sessions.scan(sess, status.ScanID)
+	if err != nil {
+		e.displayError(w, err, http.StatusNotFound)
+		return
+	}
+	coll := sc.Configs()
+	if coll == nil {
+		e.displayError(w, errors.New("scan doesn't have results"), http.StatusNotFound)
+		return
+	}
 
 	// create a json file
 	f, err := coll.ToJSONFile()
@@ -128,52 +206,149 @@ func (e *env) handleRegexpPOST(w http.ResponseWriter, r *http.Request) {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
 	// create a download link for json file
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", f.Name()))
+	name := filepath.Base(f.Name())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
 	w.Header().Set("Content-Type", "application/json")
-	http.ServeContent(w, r, f.Name(), time.Now(), f)
-}
-
-func (e *env) handleSearch(w http.ResponseWriter, r *http.Request) {
-	e.render(w, "create.page.tmpl", nil)
+	http.ServeContent(w, r, name, time.Now(), f)
 }
 
-func (e *env) handleSearchQuery(w http.ResponseWriter, r *http.Request) {
-	// parse values from url query
-	url := r.URL.Query().Get("url")
-	hash := r.URL.Query().Get("commit")
-	dir := r.URL.Query().Get("dir")
-
-	// get hash and file collections
-	coll, err := crud.GetGitCollection(url, hash, dir)
+// handleJobCancel cancels a job of a user's session and returns user to it's page.
+func (e *env) handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
 	if err != nil {
 		e.displayError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	// save collection to cache
-	e.gitCollectionFiles = coll
+	id := mux.Vars(r)["id"]
+	if err := e.jobs.cancel(sess.id, id); err == errJobNotFound {
+		e.displayError(w, err, http.StatusNotFound)
+		return
+	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, "/jobs/"+id, http.StatusFound)
+}
+
+// filesPage is data of Files page, files of a scan that have a selected attribute.
+type filesPage struct {
+	*crud.GitCollection
+
+	Attribute  string   // selected attribute, a leading ! hides files that have it, empty if all files are shown
+	Attributes []string // all attributes files can have
 }
 
 func (e *env) handleFiles(w http.ResponseWriter, r *http.Request) {
-	if e.gitCollectionFiles == nil {
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	sc := sess.Current()
+	if sc == nil {
 		e.render(w, "home.page.tmpl", nil)
-	} else {
-		e.render(w, "home.page.tmpl", e.gitCollectionFiles)
+		return
+	}
+
+	page := &filesPage{
+		GitCollection: sc.Files(),
+		Attribute:     r.URL.Query().Get("attribute"),
+		Attributes:    crud.Attributes,
+	}
+	if page.Attribute != "" {
+		page.GitCollection, err = page.WithAttributes([]string{page.Attribute})
+		if err != nil {
+			e.displayError(w, err, http.StatusBadRequest)
+			return
+		}
 	}
+
+	e.render(w, "home.page.tmpl", page)
+}
+
+// filterPage holds default rules a filter page offers, they are nil if a user didn't search a repository yet.
+type filterPage struct {
+	RepoFilterName  string
+	RepoFilterError string
+
+	Default *crud.FilterConfig // rules of a repository combined with baseline rules of a server
+	Mode    string
 }
 
 func (e *env) handleFilter(w http.ResponseWriter, r *http.Request) {
-	e.render(w, "filter.page.tmpl", nil)
+	page := &filterPage{Mode: e.config.Filter.Mode}
+	if page.Mode == "" {
+		page.Mode = crud.MergeRules
+	}
+
+	if sess, err := e.session(w, r); err == nil {
+		if sc := sess.Current(); sc != nil {
+			files := sc.Files()
+			page.RepoFilterName, page.RepoFilterError = files.RepoFilterName, files.RepoFilterError
+			page.Default, _ = e.defaultFilter(sc)
+		}
+	}
+
+	e.render(w, "filter.page.tmpl", page)
 }
 
 func (e *env) handleConfigs(w http.ResponseWriter, r *http.Request) {
-	if e.gitCollectionConfigs == nil {
-		e.render(w, "configs.page.tmpl", nil)
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if sc := sess.Current(); sc != nil && sc.Configs() != nil {
+		e.render(w, "configs.page.tmpl", sc.Configs())
 	} else {
-		e.render(w, "configs.page.tmpl", e.gitCollectionConfigs)
+		e.render(w, "configs.page.tmpl", nil)
 	}
 }
+
+// handleScans shows all scans that user made in current session.
+func (e *env) handleScans(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	e.render(w, "scans.page.tmpl", sess)
+}
+
+// handleScanUse makes a scan current, so Files and Configs pages show it.
+func (e *env) handleScanUse(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err = sess.use(mux.Vars(r)["id"]); err != nil {
+		e.displayError(w, err, http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// handleScanDelete removes a scan from a session.
+func (e *env) handleScanDelete(w http.ResponseWriter, r *http.Request) {
+	sess, err := e.session(w, r)
+	if err != nil {
+		e.displayError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err = e.sessions.removeScan(sess, mux.Vars(r)["id"]); err != nil {
+		e.displayError(w, err, http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/scans", http.StatusFound)
+}
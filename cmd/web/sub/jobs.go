@@ -0,0 +1,468 @@
+package sub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/bejaneps/go-git-webapp/internal/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWorkers = 4                // count of jobs that can run at once
+	queuePerWorker = 4                // count of jobs that can wait in a queue for each worker
+	jobTTL         = 30 * time.Minute // time after which a finished job is removed
+)
+
+var (
+	// errQueueFull is used when there are too many jobs waiting to be run.
+	errQueueFull = errors.New("too many scans are waiting, try again later")
+
+	// errJobNotFound is used when a job doesn't exist or was expired.
+	errJobNotFound = errors.New("job not found")
+
+	// errJobFinished is used when a finished job is canceled.
+	errJobFinished = errors.New("job is already finished")
+)
+
+// jobState is a state of a job, states between queued and done are the same as crud stages.
+type jobState string
+
+// States of a job.
+const (
+	jobQueued     jobState = "queued"
+	jobCloning    jobState = jobState(crud.StageCloning)
+	jobIndexing   jobState = jobState(crud.StageIndexing)
+	jobFiltering  jobState = jobState(crud.StageFiltering)
+	jobEvaluating jobState = jobState(crud.StageEvaluating)
+	jobDone       jobState = "done"
+	jobFailed     jobState = "failed"
+	jobCanceled   jobState = "canceled"
+)
+
+// finished returns true if a job in state s won't change anymore.
+func (s jobState) finished() bool {
+	return s == jobDone || s == jobFailed || s == jobCanceled
+}
+
+// jobKind tells what a job does.
+type jobKind string
+
+// Kinds of a job.
+const (
+	jobScan   jobKind = "scan"   // clones and indexes a repository, a new scan is shown on files page when it's done
+	jobFilter jobKind = "filter" // filters an existing scan, results can be downloaded from a job page when it's done
+)
+
+// jobFunc is a work done by a job, it should report it's progress and return an id of a scan it created or used.
+type jobFunc func(ctx context.Context, progress crud.ProgressFunc) (scanID string, err error)
+
+// job is a scan or filter that runs in background.
+type job struct {
+	mu sync.RWMutex
+
+	id       string
+	session  string // id of a session that started a job, only it can see and cancel the job
+	kind     jobKind
+	state    jobState
+	percent  int
+	err      error
+	scanID   string
+	created  time.Time
+	finished time.Time
+
+	run    jobFunc
+	cancel context.CancelFunc
+}
+
+// jobStatus is a snapshot of a job, it's safe to pass to templates and encode to json.
+type jobStatus struct {
+	ID       string     `json:"id"`
+	Kind     jobKind    `json:"kind"`
+	State    jobState   `json:"state"`
+	Percent  int        `json:"percent"`
+	Error    string     `json:"error,omitempty"`
+	ScanID   string     `json:"scan_id,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Done returns true if a job finished successfully.
+func (s jobStatus) Done() bool {
+	return s.State == jobDone
+}
+
+// IsFinished returns true if a job won't change anymore.
+func (s jobStatus) IsFinished() bool {
+	return s.State.finished()
+}
+
+// status returns a snapshot of a job.
+func (j *job) status() jobStatus {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	s := jobStatus{
+		ID:      j.id,
+		Kind:    j.kind,
+		State:   j.state,
+		Percent: j.percent,
+		ScanID:  j.scanID,
+		Created: j.created,
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		s.Finished = &finished
+	}
+
+	return s
+}
+
+// progress updates a state and a percent of a running job.
+func (j *job) progress(stage crud.Stage, percent int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state.finished() {
+		return
+	}
+	j.state = jobState(stage)
+	j.percent = percent
+}
+
+// finish sets a final state of a job.
+func (j *job) finish(scanID string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state.finished() {
+		return
+	}
+
+	j.scanID = scanID
+	j.finished = time.Now()
+	switch {
+	case err == nil:
+		j.state = jobDone
+		j.percent = 100
+	case errors.Cause(err) == context.Canceled:
+		j.state = jobCanceled
+		j.err = err
+	default:
+		j.state = jobFailed
+		j.err = err
+	}
+}
+
+// jobManager runs jobs in a bounded pool of workers, it's safe for concurrent use.
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+
+	queue chan *job
+	ctx   context.Context // canceled when server shuts down
+}
+
+// newJobManager is a constructor for jobManager, it starts workers that run jobs until ctx is canceled.
+func newJobManager(ctx context.Context, workers int) *jobManager {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	m := &jobManager{
+		jobs:  make(map[string]*job),
+		queue: make(chan *job, workers*queuePerWorker),
+		ctx:   ctx,
+	}
+
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+
+	return m
+}
+
+// work runs jobs from a queue one by one.
+func (m *jobManager) work() {
+	for {
+		select {
+		case j := <-m.queue:
+			m.runJob(j)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// runJob runs a single job, unless it was canceled while waiting in a queue.
+func (m *jobManager) runJob(j *job) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+
+	j.mu.Lock()
+	if j.state.finished() {
+		j.mu.Unlock()
+		return
+	}
+	j.cancel = cancel
+	j.mu.Unlock()
+
+	scanID, err := j.run(ctx, j.progress)
+	if err != nil && ctx.Err() == context.Canceled {
+		err = context.Canceled // errors of go-git and opa don't always keep the cause
+	}
+	j.finish(scanID, err)
+}
+
+// submit puts a new job of a session in a queue, it returns errQueueFull if a queue doesn't have free space.
+func (m *jobManager) submit(session string, kind jobKind, run jobFunc) (*job, error) {
+	id, err := util.RandomToken(sessionIDLen)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		id:      id,
+		session: session,
+		kind:    kind,
+		state:   jobQueued,
+		created: time.Now(),
+		run:     run,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case m.queue <- j:
+		m.jobs[id] = j
+	default:
+		return nil, errQueueFull
+	}
+
+	return j, nil
+}
+
+// get returns a job by id, jobs of other sessions aren't found.
+func (m *jobManager) get(session, id string) (*job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok || j.session != session {
+		return nil, errJobNotFound
+	}
+
+	return j, nil
+}
+
+// cancel stops a running job of a session, or removes it from a queue if it didn't start yet.
+func (m *jobManager) cancel(session, id string) error {
+	j, err := m.get(session, id)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	if j.state.finished() {
+		j.mu.Unlock()
+		return errJobFinished
+	}
+	cancel := j.cancel
+	j.mu.Unlock()
+
+	if cancel != nil {
+		cancel() // runJob will finish a job as canceled
+	} else {
+		j.finish("", context.Canceled)
+	}
+
+	return nil
+}
+
+// expire removes all jobs that finished since jobTTL before now.
+func (m *jobManager) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, j := range m.jobs {
+		if s := j.status(); s.Finished != nil && now.Sub(*s.Finished) > jobTTL {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// collect periodically removes finished jobs until done is closed.
+func (m *jobManager) collect(done <-chan struct{}) {
+	ticker := time.NewTicker(collectPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.expire(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// scanRequest holds parameters of a new scan.
+type scanRequest struct {
+	URL string `json:"url"`
+	Ref string `json:"ref"`
+	Dir string `json:"dir"`
+
+	Include []string `json:"include"` // optional, directories scanned besides dir, all if both are empty
+	Exclude []string `json:"exclude"` // optional, directories that are skipped
+
+	Auth   *crud.Credentials   `json:"auth"`   // optional, shared credentials of a host from server config are used if it isn't set, see crud.HostCredentials.Shared
+	Fetch  *crud.FetchPolicy   `json:"fetch"`  // optional, fetch policy from server config is used if it isn't set
+	Clone  *crud.CloneStrategy `json:"clone"`  // optional, clone strategy from server config is used if it isn't set
+	Config []crud.Config       `json:"config"` // optional, a new scan is filtered if it's set
+
+	PolicyDir string `json:"policy_dir"` // optional, policy directory from server config is used if it isn't set
+
+	ConfigExclude    []string `json:"config_exclude"`     // optional, glob patterns of files no rule of config matches
+	ConfigFirstMatch bool     `json:"config_first_match"` // optional, files are matched only by the first rule of config they match
+	ConfigNamespace  string   `json:"config_namespace"`   // optional, package of policies of config, main by default
+
+	// DefaultConfig tells to filter a new scan with rules of a repository and baseline rules of a server
+	// if Config isn't set, optional.
+	DefaultConfig bool `json:"default_config"`
+}
+
+// scanJob returns a job that clones a repository and saves it as a new scan in sess,
+// if req.Config isn't nil or req.DefaultConfig is set, a new scan is also filtered.
+func (e *env) scanJob(sess *session, req *scanRequest) jobFunc {
+	// credentials of a host are only used for repositories they list, since any user can send a request,
+	// credentials of a request check host keys like ones of server config do
+	auth := e.config.Hosts.Shared(req.URL)
+	if req.Auth != nil {
+		auth = req.Auth.WithHostKeys(e.config.Hosts.For(req.URL))
+	}
+	fetch := e.config.Fetch
+	if req.Fetch != nil {
+		fetch = *req.Fetch
+	}
+	clone := e.config.Clone
+	if req.Clone != nil {
+		clone = *req.Clone
+	}
+	policyDir := e.config.PolicyDir
+	if req.PolicyDir != "" {
+		policyDir = req.PolicyDir
+	}
+
+	return func(ctx context.Context, progress crud.ProgressFunc) (string, error) {
+		coll, err := crud.GetGitCollectionContext(ctx, req.URL, req.Ref, req.Dir, &crud.Options{
+			Progress: progress,
+			Auth:     auth,
+			Fetch:    fetch,
+			Clone:    clone,
+			Cache:    e.cache,
+			Include:  req.Include,
+			Exclude:  req.Exclude,
+
+			MaxBlobSize: e.config.maxBlobSize,
+			Workers:     e.config.Workers,
+			PolicyDir:   policyDir,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		sc, err := newScan(coll)
+		if err != nil {
+			coll.Close()
+			return "", err
+		}
+
+		if req.Config != nil || req.DefaultConfig {
+			var conf *crud.FilterConfig
+			if req.Config != nil {
+				conf = &crud.FilterConfig{
+					Config:     req.Config,
+					Exclude:    req.ConfigExclude,
+					FirstMatch: req.ConfigFirstMatch,
+					Namespace:  req.ConfigNamespace,
+				}
+			}
+			if err = e.filterScan(ctx, sc, conf, progress); err != nil {
+				sc.close()
+				return "", err
+			}
+		}
+		e.sessions.addScan(sess, sc)
+
+		return sc.ID, nil
+	}
+}
+
+// filterJob returns a job that filters files of an existing scan, with default rules if req is nil.
+func (e *env) filterJob(sc *scan, req *crud.FilterConfig) jobFunc {
+	return func(ctx context.Context, progress crud.ProgressFunc) (string, error) {
+		return sc.ID, e.filterScan(ctx, sc, req, progress)
+	}
+}
+
+// defaultFilter returns rules of a scanned repository combined with baseline rules of a server.
+func (e *env) defaultFilter(sc *scan) (*crud.FilterConfig, error) {
+	return sc.Files().DefaultFilter(e.config.Filter.baseline, e.config.Filter.Mode)
+}
+
+// policyChain returns where policies of rules are loaded from, policies of rules can't be paths
+// on disk of a server, git sources are cloned like scanned repositories.
+func (e *env) policyChain() *crud.PolicyChain {
+	return &crud.PolicyChain{
+		Org:     e.config.Policies.Org,
+		Default: e.config.Policies.Default,
+		Git: crud.Options{
+			Fetch: e.config.Fetch,
+			Clone: e.config.Clone,
+			Cache: e.cache,
+		},
+		Hosts: e.config.Hosts,
+		Cache: e.policies,
+	}
+}
+
+// filterScan filters files of a scan and saves the result in it, req is nil if a user didn't give rules,
+// then rules of a repository and baseline rules of a server are used.
+func (e *env) filterScan(ctx context.Context, sc *scan, req *crud.FilterConfig, progress crud.ProgressFunc) error {
+	// content of files is read from a repository of a scan, it's kept open even if a scan is removed meanwhile
+	if err := sc.acquire(); err != nil {
+		return err
+	}
+	defer sc.release()
+
+	if req == nil {
+		var err error
+		if req, err = e.defaultFilter(sc); err != nil {
+			return err
+		}
+	}
+
+	opts := req.Options()
+	opts.Progress = progress
+	opts.Policies = e.policyChain()
+
+	files := sc.Files()
+	coll, err := files.FilterContext(ctx, req.Config, opts)
+	if err != nil {
+		return err
+	}
+
+	// write in json file also the file count in repo and count of programming langs used
+	coll.FileCount = files.FileCount
+	coll.Language = files.Language
+
+	sc.setConfigs(coll)
+
+	return nil
+}
@@ -7,24 +7,33 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
-	"github.com/bejaneps/go-git-webapp/internal/crud"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 )
 
-var listenPort = ":" + os.Getenv("PORT")
+var (
+	listenPort  = ":" + os.Getenv("PORT")
+	sessionTTL  = os.Getenv("SESSION_TTL")
+	scanWorkers = os.Getenv("SCAN_WORKERS")
+)
 
 // env is a collection that holds dependencies needed to pass to route handlers
 type env struct {
 	router *mux.Router
 
-	gitCollectionFiles   *crud.GitCollection
-	gitCollectionConfigs *crud.GitCollection
+	config   *serverConfig
+	sessions *sessionStore
+	jobs     *jobManager
+	cache    *crud.Cache
+	policies *crud.PolicyCache
 
 	templateCache map[string]*template.Template
 }
@@ -81,13 +90,55 @@ func newTemplateCache(dir string) (map[string]*template.Template, error) {
 }
 
 // newEnv is a constructor for main environment type,
-// used for dependency injections.
-func newEnv() (*env, error) {
+// used for dependency injections. Background workers of env run until ctx is canceled.
+func newEnv(ctx context.Context) (*env, error) {
 	var op = "cmd.newEnv"
 	var err error
 
 	e := &env{}
 
+	// read a server config
+	e.config, err = loadConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): loading config", op)
+	}
+
+	// open a repository cache
+	e.cache, err = e.config.Cache.newCache()
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): opening repository cache", op)
+	}
+
+	// policies are cached between scans, until their sources change
+	var timeout time.Duration
+	if e.config.Policies.Timeout != "" {
+		timeout, err = time.ParseDuration(e.config.Policies.Timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): parsing policies timeout", op)
+		}
+	}
+	e.policies = crud.NewPolicyCache(timeout)
+
+	// parse an idle time of sessions, e.g: 45m
+	var ttl time.Duration
+	if sessionTTL != "" {
+		ttl, err = time.ParseDuration(sessionTTL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): parsing SESSION_TTL", op)
+		}
+	}
+	e.sessions = newSessionStore(ttl)
+
+	// parse a count of scans that can run at once
+	var workers int
+	if scanWorkers != "" {
+		workers, err = strconv.Atoi(scanWorkers)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): parsing SCAN_WORKERS", op)
+		}
+	}
+	e.jobs = newJobManager(ctx, workers)
+
 	// register routes and router
 	e.router = mux.NewRouter()
 	e.routes()
@@ -107,7 +158,10 @@ func newEnv() (*env, error) {
 func Execute() (err error) {
 	var op = "cmd.Execute"
 
-	e, err := newEnv()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e, err := newEnv(ctx)
 	if err != nil {
 		err = errors.Wrapf(err, "(%s): initializing env", op)
 		return
@@ -126,6 +180,11 @@ func Execute() (err error) {
 		WriteTimeout: 20 * time.Second,
 	}
 
+	// remove idle sessions, finished jobs and unused repositories in background
+	go e.sessions.collect(ctx.Done())
+	go e.jobs.collect(ctx.Done())
+	go e.collectCache(ctx.Done())
+
 	// listen and serve connections
 	errChan := make(chan error)
 	go func(errChan chan<- error) {
@@ -25,6 +25,35 @@ func (e *env) routes() {
 	e.router.HandleFunc("/regexp", e.catchPanic(e.handleRegexpGET)).Methods("GET")
 	e.router.HandleFunc("/regexp", e.catchPanic(e.handleRegexpPOST)).Methods("POST")
 
+	// routes for background jobs page
+	e.router.HandleFunc("/jobs/{id}", e.catchPanic(e.handleJob)).Methods("GET")
+	e.router.HandleFunc("/jobs/{id}/cancel", e.catchPanic(e.handleJobCancel)).Methods("POST")
+	e.router.HandleFunc("/jobs/{id}/results", e.catchPanic(e.handleJobResults)).Methods("GET")
+
+	// routes for saved scans page
+	e.router.HandleFunc("/scans", e.catchPanic(e.handleScans))
+	e.router.HandleFunc("/scans/{id}/use", e.catchPanic(e.handleScanUse)).Methods("POST")
+	e.router.HandleFunc("/scans/{id}/delete", e.catchPanic(e.handleScanDelete)).Methods("POST")
+
 	// route for filter page
 	e.router.HandleFunc("/filter", e.catchPanic(e.handleFilter))
+
+	// routes for json api
+	api := e.router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/openapi.json", e.catchPanicJSON(e.handleAPIDocs)).Methods("GET")
+	api.HandleFunc("/filter.schema.json", e.catchPanicJSON(e.handleAPIFilterSchema)).Methods("GET")
+	api.HandleFunc("/types", e.catchPanicJSON(e.handleAPITypes)).Methods("GET")
+	api.HandleFunc("/scans", e.catchPanicJSON(e.handleAPIScanCreate)).Methods("POST")
+	api.HandleFunc("/scans/{id}", e.catchPanicJSON(e.handleAPIScan)).Methods("GET")
+	api.HandleFunc("/scans/{id}/files", e.catchPanicJSON(e.handleAPIScanFiles)).Methods("GET")
+	api.HandleFunc("/scans/{id}/languages", e.catchPanicJSON(e.handleAPIScanLanguages)).Methods("GET")
+	api.HandleFunc("/scans/{id}/filter", e.catchPanicJSON(e.handleAPIScanFilter)).Methods("POST")
+	api.HandleFunc("/scans/{id}/results", e.catchPanicJSON(e.handleAPIScanResults)).Methods("GET")
+	api.HandleFunc("/jobs/{id}", e.catchPanicJSON(e.handleAPIJob)).Methods("GET")
+	api.HandleFunc("/jobs/{id}", e.catchPanicJSON(e.handleAPIJobCancel)).Methods("DELETE")
+
+	// routes for admin api, they require admin token
+	api.HandleFunc("/admin/cache", e.catchPanicJSON(e.requireAdmin(e.handleAdminCache))).Methods("GET")
+	api.HandleFunc("/admin/cache", e.catchPanicJSON(e.requireAdmin(e.handleAdminCachePurge))).Methods("DELETE")
+	api.HandleFunc("/admin/cache/{key}", e.catchPanicJSON(e.requireAdmin(e.handleAdminCacheRemove))).Methods("DELETE")
 }
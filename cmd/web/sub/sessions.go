@@ -0,0 +1,386 @@
+package sub
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	"github.com/bejaneps/go-git-webapp/internal/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionCookie = "gff_session"     // name of a cookie that holds a session id
+	sessionHeader = "X-Session-Token" // header that can be used instead of a cookie
+	sessionIDLen  = 16                // count of random bytes in session and scan ids
+	defaultTTL    = 30 * time.Minute  // idle time after which session and it's scans are removed
+	collectPeriod = 1 * time.Minute   // how often idle sessions are collected
+)
+
+// errScanNotFound is used when a scan doesn't exist or was expired.
+var errScanNotFound = errors.New("scan not found")
+
+// scan is a single search of a repository made by user,
+// it holds all files of a repository and the result of the last filter.
+type scan struct {
+	mu sync.RWMutex
+
+	ID       string
+	Created  time.Time
+	lastUsed time.Time
+
+	files   *crud.GitCollection
+	configs *crud.GitCollection
+
+	// a repository of a scan is released when it's removed and no filter reads content of it's files
+	refs      int
+	removed   bool
+	closeOnce sync.Once
+}
+
+// Files returns a collection of all files found in a scan.
+func (s *scan) Files() *crud.GitCollection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.files
+}
+
+// Configs returns a collection of files from the last filter, or nil if scan wasn't filtered yet.
+func (s *scan) Configs() *crud.GitCollection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.configs
+}
+
+// acquire keeps a repository files of a scan are read from open until release is called,
+// so a scan removed or expired while it's filtered isn't closed under a filter.
+// It returns errScanNotFound if a scan was already removed.
+func (s *scan) acquire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.removed {
+		return errScanNotFound
+	}
+	s.refs++
+
+	return nil
+}
+
+// release ends a use of a scan started by acquire, a repository of a removed scan is released by the last one.
+func (s *scan) release() {
+	s.mu.Lock()
+	s.refs--
+	idle := s.removed && s.refs == 0
+	s.mu.Unlock()
+
+	if idle {
+		s.closeOnce.Do(s.files.Close)
+	}
+}
+
+// close releases a repository files of a scan are read from, it's called when a scan is removed or expired.
+// If a scan is being filtered, it's released when the last filter finishes.
+func (s *scan) close() {
+	s.mu.Lock()
+	s.removed = true
+	idle := s.refs == 0
+	s.mu.Unlock()
+
+	if idle {
+		s.closeOnce.Do(s.files.Close)
+	}
+}
+
+// setConfigs saves a result of filter in a scan.
+func (s *scan) setConfigs(coll *crud.GitCollection) {
+	s.mu.Lock()
+	s.configs = coll
+	s.mu.Unlock()
+}
+
+// session is a workspace of a single user, it holds all the scans that user made
+// and the one that is currently used by pages.
+type session struct {
+	mu sync.Mutex
+
+	id       string
+	lastSeen time.Time
+
+	scans   []*scan
+	current *scan
+}
+
+// add appends a scan to a session and makes it current.
+func (s *session) add(sc *scan) {
+	s.mu.Lock()
+	s.scans = append(s.scans, sc)
+	s.current = sc
+	s.mu.Unlock()
+}
+
+// use makes a scan with id current.
+func (s *session) use(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range s.scans {
+		if sc.ID == id {
+			s.current = sc
+			return nil
+		}
+	}
+
+	return errScanNotFound
+}
+
+// scan returns a scan with id of a session.
+func (s *session) scan(id string) (*scan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range s.scans {
+		if sc.ID == id {
+			return sc, nil
+		}
+	}
+
+	return nil, errScanNotFound
+}
+
+// remove deletes a scan with id from a session, and returns it.
+func (s *session) remove(id string) (*scan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sc := range s.scans {
+		if sc.ID == id {
+			s.scans = append(s.scans[:i], s.scans[i+1:]...)
+			if s.current == sc {
+				s.current = nil
+				if len(s.scans) != 0 {
+					s.current = s.scans[len(s.scans)-1]
+				}
+			}
+			return sc, nil
+		}
+	}
+
+	return nil, errScanNotFound
+}
+
+// Current returns a scan that is used by pages, or nil if user didn't search any repository.
+func (s *session) Current() *scan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.current
+}
+
+// Scans returns all scans of a session, newest first.
+func (s *session) Scans() []*scan {
+	s.mu.Lock()
+	scans := make([]*scan, len(s.scans))
+	copy(scans, s.scans)
+	s.mu.Unlock()
+
+	sort.SliceStable(scans, func(i, j int) bool {
+		return scans[i].Created.After(scans[j].Created)
+	})
+
+	return scans
+}
+
+// sessionStore holds all sessions of a server and an index of their scans by id,
+// it's safe for concurrent use.
+type sessionStore struct {
+	mu sync.Mutex
+
+	ttl      time.Duration
+	sessions map[string]*session
+	scans    map[string]*scan
+}
+
+// newSessionStore is a constructor for sessionStore,
+// sessions that weren't used for ttl are removed by collect.
+func newSessionStore(ttl time.Duration) *sessionStore {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	return &sessionStore{
+		ttl:      ttl,
+		sessions: make(map[string]*session),
+		scans:    make(map[string]*scan),
+	}
+}
+
+// get returns a session by id, and marks it as used.
+func (st *sessionStore) get(id string) (*session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[id]
+	if ok {
+		s.lastSeen = time.Now()
+	}
+
+	return s, ok
+}
+
+// create makes a new session with a random id.
+func (st *sessionStore) create() (*session, error) {
+	id, err := util.RandomToken(sessionIDLen)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		id:       id,
+		lastSeen: time.Now(),
+	}
+
+	st.mu.Lock()
+	st.sessions[id] = s
+	st.mu.Unlock()
+
+	return s, nil
+}
+
+// addScan saves a scan in a session and makes it reachable by id.
+func (st *sessionStore) addScan(s *session, sc *scan) {
+	st.mu.Lock()
+	sc.lastUsed = time.Now()
+	st.scans[sc.ID] = sc
+	st.mu.Unlock()
+
+	s.add(sc)
+}
+
+// removeScan deletes a scan with id from a session and from the index, and releases it's repository.
+func (st *sessionStore) removeScan(s *session, id string) error {
+	sc, err := s.remove(id)
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	delete(st.scans, sc.ID)
+	st.mu.Unlock()
+
+	sc.close()
+
+	return nil
+}
+
+// scan returns a scan by id of a session, and marks it as used. Scans of other sessions aren't found,
+// so a scan of another user can't be read or filtered even if it's id is known.
+func (st *sessionStore) scan(s *session, id string) (*scan, error) {
+	sc, err := s.scan(id)
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	sc.lastUsed = time.Now()
+	st.mu.Unlock()
+
+	return sc, nil
+}
+
+// expire removes all sessions that weren't used since ttl before now,
+// and all idle scans that don't belong to any remaining session,
+// it returns the count of removed sessions.
+func (st *sessionStore) expire(now time.Time) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var count int
+	live := make(map[*scan]bool)
+	for id, s := range st.sessions {
+		if now.Sub(s.lastSeen) > st.ttl {
+			delete(st.sessions, id)
+			count++
+			continue
+		}
+
+		for _, sc := range s.Scans() {
+			live[sc] = true
+		}
+	}
+
+	for id, sc := range st.scans {
+		if !live[sc] && now.Sub(sc.lastUsed) > st.ttl {
+			delete(st.scans, id)
+			sc.close()
+		}
+	}
+
+	return count
+}
+
+// collect periodically removes idle sessions until done is closed.
+func (st *sessionStore) collect(done <-chan struct{}) {
+	ticker := time.NewTicker(collectPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			st.expire(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// newScan creates a scan with a random id for a collection of files.
+func newScan(coll *crud.GitCollection) (*scan, error) {
+	id, err := util.RandomToken(sessionIDLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scan{
+		ID:      id,
+		Created: time.Now(),
+		files:   coll,
+	}, nil
+}
+
+// session returns a session of a user making a request, session id is taken from a cookie or
+// from X-Session-Token header, if there is no valid session a new one is created and a cookie is set.
+func (e *env) session(w http.ResponseWriter, r *http.Request) (*session, error) {
+	var op = "cmd.session"
+
+	id := r.Header.Get(sessionHeader)
+	if id == "" {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			id = c.Value
+		}
+	}
+
+	if s, ok := e.sessions.get(id); ok {
+		return s, nil
+	}
+
+	s, err := e.sessions.create()
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): creating a session", op)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(sessionHeader, s.id)
+
+	return s, nil
+}
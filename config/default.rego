@@ -1,3 +0,0 @@
-package example
-
-msg := "policy applied successfully"
\ No newline at end of file
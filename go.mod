@@ -6,16 +6,26 @@ require (
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
 	github.com/ghodss/yaml v1.0.0
+	github.com/go-enry/go-enry/v2 v2.9.6
 	github.com/gorilla/mux v1.7.4
 	github.com/hashicorp/hcl/v2 v2.3.0
 	github.com/hashicorp/terraform v0.12.24
 	github.com/hashicorp/terraform-json v0.4.0
-	github.com/json-iterator/go v1.1.9
+	// json-iterator before v1.1.12 uses reflect2 v1.0.1, it reads runtime internals of maps
+	// and crashes encoding any map when built with go 1.18 or newer
+	github.com/json-iterator/go v1.1.12
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/open-policy-agent/opa v0.18.0
+	github.com/pelletier/go-toml v1.9.5
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/common v0.2.0
 	github.com/sirupsen/logrus v1.4.2
-	github.com/src-d/enry/v2 v2.1.0
+	github.com/xeipuuv/gojsonschema v1.2.0
 	github.com/zclconf/go-cty v1.2.1
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+	gopkg.in/src-d/go-billy.v4 v4.3.2
 	gopkg.in/src-d/go-git.v4 v4.13.1
+	// yaml.v3 only decodes filter rules, since it's nodes have lines and columns of fields,
+	// yaml files of repositories are decoded with ghodss/yaml
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,131 @@
+package crud
+
+import (
+	"io"
+	"strings"
+
+	enry "github.com/go-enry/go-enry/v2"
+	"github.com/pkg/errors"
+)
+
+// Attributes of files, they are detected by enry the same way GitHub linguist does.
+const (
+	AttrBinary        = "binary"
+	AttrVendored      = "vendored"
+	AttrGenerated     = "generated"
+	AttrDocumentation = "documentation"
+	AttrConfiguration = "configuration"
+	AttrTest          = "test"
+)
+
+// Attributes are all attributes a file can have, in order they are reported.
+var Attributes = []string{AttrBinary, AttrVendored, AttrGenerated, AttrDocumentation, AttrConfiguration, AttrTest}
+
+// sniffLen is a count of first bytes of a file that are read to detect if it's binary or generated,
+// and it's language if it can't be detected by name.
+const sniffLen = 8000
+
+// classify returns attributes of a file, head is the beginning of it's content,
+// it's nil if content isn't read, then a file is only binary if it's name is an image.
+func classify(name string, head []byte) []string {
+	var attrs []string
+
+	if head != nil && enry.IsBinary(head) || head == nil && enry.IsImage(name) {
+		attrs = append(attrs, AttrBinary)
+	}
+	if enry.IsVendor(name) {
+		attrs = append(attrs, AttrVendored)
+	}
+	if enry.IsGenerated(name, head) {
+		attrs = append(attrs, AttrGenerated)
+	}
+	if enry.IsDocumentation(name) {
+		attrs = append(attrs, AttrDocumentation)
+	}
+	if enry.IsConfiguration(name) {
+		attrs = append(attrs, AttrConfiguration)
+	}
+	if enry.IsTest(name) {
+		attrs = append(attrs, AttrTest)
+	}
+
+	return attrs
+}
+
+// sniff returns first sniffLen bytes of a source file.
+func (f sourceFile) sniff() ([]byte, error) {
+	rc, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(rc, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return head[:n], err
+}
+
+// ValidateAttributes returns an error if some of attributes is unknown,
+// an attribute can have a leading ! which means a file must not have it.
+func ValidateAttributes(attrs []string) error {
+	var op = "crud.ValidateAttributes"
+
+	for _, a := range attrs {
+		name := strings.TrimPrefix(a, "!")
+
+		var ok bool
+		for _, known := range Attributes {
+			ok = ok || name == known
+		}
+		if !ok {
+			return errors.Errorf("(%s): unknown attribute %q, must be one of %s", op, a, strings.Join(Attributes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Is returns true if a file has an attribute.
+func (f file) Is(attr string) bool {
+	for _, a := range f.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasAttributes returns true if a file has all attrs, and doesn't have any of them with a leading !.
+func (f file) hasAttributes(attrs []string) bool {
+	for _, a := range attrs {
+		if strings.HasPrefix(a, "!") == f.Is(strings.TrimPrefix(a, "!")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WithAttributes returns a copy of a collection that only has files with attrs,
+// attributes with a leading ! are ones files must not have, e.g: ["configuration", "!vendored"].
+func (c *GitCollection) WithAttributes(attrs []string) (*GitCollection, error) {
+	if err := ValidateAttributes(attrs); err != nil {
+		return nil, err
+	}
+
+	cp := *c
+	cp.release = nil // a copy doesn't own a repository
+	cp.Coll = make([]file, 0, len(c.Coll))
+	for _, f := range c.Coll {
+		if f.hasAttributes(attrs) {
+			cp.Coll = append(cp.Coll, f)
+		}
+	}
+
+	return &cp, nil
+}
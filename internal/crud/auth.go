@@ -0,0 +1,215 @@
+package crud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	neturl "net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// defaultTokenUser is a username sent with a token when user didn't specify one,
+// git hosting services ignore it, but basic auth requires some username.
+const defaultTokenUser = "git"
+
+// Credentials holds secrets used to clone private repositories,
+// they are only decoded from server config and api requests, and never written anywhere.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"` // personal access token, sent as a basic auth password
+
+	SSHKey           string `json:"ssh_key"`            // path to a private key file, only in server config
+	SSHKeyData       string `json:"ssh_key_data"`       // a pem encoded private key, it takes precedence over SSHKey
+	SSHKeyPassphrase string `json:"ssh_key_passphrase"` // passphrase of an encrypted private key
+	KnownHosts       string `json:"known_hosts"`        // comma separated paths to known_hosts files, ~/.ssh/known_hosts if empty, only in server config
+	InsecureHostKey  bool   `json:"insecure_host_key"`  // don't check a host key of ssh server, only in server config
+
+	// Repositories are repositories of a host any user can clone with these credentials, e.g: github.com/org/ for
+	// all repositories of an organization, only in server config. If it's empty, credentials of a host are only used
+	// for sources of server config, e.g: an organization policy, and not for repositories of api requests.
+	Repositories []string `json:"repositories"`
+}
+
+// ErrUntrustedCredentials is used when credentials of an untrusted user, e.g: of an api request,
+// have settings that read files of a server or weaken host key checks.
+var ErrUntrustedCredentials = errors.New("ssh_key, known_hosts, insecure_host_key and repositories can only be set in server config, use ssh_key_data to pass a key")
+
+// ValidateUntrusted returns ErrUntrustedCredentials if credentials have paths of files or turn off
+// host key checks, only inline keys, passwords and tokens can be given by untrusted users.
+func (c *Credentials) ValidateUntrusted() error {
+	if c != nil && (c.SSHKey != "" || c.KnownHosts != "" || c.InsecureHostKey || len(c.Repositories) > 0) {
+		return ErrUntrustedCredentials
+	}
+
+	return nil
+}
+
+// WithHostKeys returns a copy of credentials that checks host keys like host credentials do,
+// so untrusted credentials use known_hosts of server config. host can be nil.
+func (c *Credentials) WithHostKeys(host *Credentials) *Credentials {
+	cp := *c
+	if host != nil {
+		cp.KnownHosts = host.KnownHosts
+		cp.InsecureHostKey = host.InsecureHostKey
+	}
+
+	return &cp
+}
+
+// fingerprint returns a sha256 of secrets of credentials, empty if there are none, so repositories cloned
+// with different credentials are cached separately, and one user's access isn't given to another.
+func (c *Credentials) fingerprint() string {
+	if c == nil {
+		return ""
+	}
+
+	secrets := []string{c.Username, c.Password, c.Token, c.SSHKey, c.SSHKeyData, c.SSHKeyPassphrase}
+	if strings.Join(secrets, "") == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(secrets, "\x00")))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// String implements fmt.Stringer, so credentials are never printed by accident.
+func (c Credentials) String() string {
+	return "[REDACTED]"
+}
+
+// GoString implements fmt.GoStringer, so credentials are never printed by accident.
+func (c Credentials) GoString() string {
+	return "crud.Credentials{[REDACTED]}"
+}
+
+// MarshalJSON implements json.Marshaler, so credentials are never written in a report.
+func (c Credentials) MarshalJSON() ([]byte, error) {
+	return []byte(`"[REDACTED]"`), nil
+}
+
+// HostCredentials maps a host name, e.g: github.com, to credentials used for all repositories on that host.
+type HostCredentials map[string]*Credentials
+
+// For returns credentials for a host of url, or nil if there are none. They are only given to trusted users,
+// e.g: in cli, or to sources of server config, see Shared for repositories of api requests.
+func (h HostCredentials) For(url string) *Credentials {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil
+	}
+
+	return h[ep.Host]
+}
+
+// Shared returns credentials for a host of url, if a repository of url is listed in their repositories,
+// so untrusted users can clone it with them, or nil otherwise.
+func (h HostCredentials) Shared(url string) *Credentials {
+	url, _ = stripCredentials(url)
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil
+	}
+	creds := h[ep.Host]
+	if creds == nil {
+		return nil
+	}
+
+	repo := ep.Host + "/" + strings.TrimSuffix(strings.Trim(ep.Path, "/"), ".git")
+	for _, r := range creds.Repositories {
+		r = strings.TrimSuffix(strings.Trim(r, "/"), ".git")
+		if repo == r || strings.HasPrefix(repo, r+"/") {
+			return creds
+		}
+	}
+
+	return nil
+}
+
+// stripCredentials removes a password from url, so it can be safely used as a cache path, in logs and in a report.
+// The password and username, if any, are returned as credentials.
+func stripCredentials(url string) (string, *Credentials) {
+	u, err := neturl.Parse(url)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return url, nil
+	}
+
+	creds := &Credentials{
+		Username: u.User.Username(),
+	}
+	creds.Password, _ = u.User.Password()
+	u.User = nil
+
+	return u.String(), creds
+}
+
+// authMethod returns a go-git auth method for cloning url with creds, it returns nil if creds are nil,
+// so go-git uses it's defaults, e.g: ssh agent.
+func authMethod(url string, creds *Credentials) (transport.AuthMethod, error) {
+	var op = "crud.authMethod"
+
+	if creds == nil {
+		return nil, nil
+	}
+
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): parsing repository url", op)
+	}
+
+	switch ep.Protocol {
+	case "http", "https":
+		if creds.Token != "" {
+			user := creds.Username
+			if user == "" {
+				user = defaultTokenUser
+			}
+
+			return &githttp.BasicAuth{Username: user, Password: creds.Token}, nil
+		} else if creds.Username != "" || creds.Password != "" {
+			return &githttp.BasicAuth{Username: creds.Username, Password: creds.Password}, nil
+		}
+	case "ssh":
+		if creds.SSHKey == "" && creds.SSHKeyData == "" {
+			return nil, nil
+		}
+
+		user := ep.User
+		if user == "" {
+			user = creds.Username
+		}
+
+		var auth *gitssh.PublicKeys
+		if creds.SSHKeyData != "" {
+			auth, err = gitssh.NewPublicKeys(user, []byte(creds.SSHKeyData), creds.SSHKeyPassphrase)
+			if err != nil {
+				return nil, errors.Wrapf(err, "(%s): parsing ssh key", op)
+			}
+		} else if auth, err = gitssh.NewPublicKeysFromFile(user, creds.SSHKey, creds.SSHKeyPassphrase); err != nil {
+			return nil, errors.Wrapf(err, "(%s): reading ssh key %s", op, creds.SSHKey)
+		}
+
+		if creds.InsecureHostKey {
+			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		} else {
+			var files []string
+			if creds.KnownHosts != "" {
+				files = strings.Split(creds.KnownHosts, ",")
+			}
+
+			auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(files...)
+			if err != nil {
+				return nil, errors.Wrapf(err, "(%s): reading known_hosts", op)
+			}
+		}
+
+		return auth, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,326 @@
+package crud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// entryFileExt is an extension of a file next to a cached repository that holds it's CacheEntry.
+const entryFileExt = ".json"
+
+var (
+	// ErrCacheEntryNotFound is used when there is no cached repository with a given key.
+	ErrCacheEntryNotFound = errors.New("cached repository not found")
+
+	// ErrCacheEntryInUse is used when a cached repository can't be removed, because files of it's scans are still read.
+	ErrCacheEntryInUse = errors.New("cached repository is in use")
+)
+
+// CacheLimits tells when cached repositories are evicted, zero values mean no limit.
+type CacheLimits struct {
+	MaxSize int64         // total size of cached repositories in bytes, least recently used are evicted first
+	MaxAge  time.Duration // repositories that weren't used longer than MaxAge are evicted
+}
+
+// CacheEntry describes a single cached repository.
+type CacheEntry struct {
+	Key   string    `json:"key"` // name of a directory repository is cloned to
+	URL   string    `json:"url"`
+	Mode  CloneMode `json:"mode"`
+	Ref   string    `json:"ref,omitempty"` // full name of a branch or a tag that was cloned alone, e.g: refs/heads/main
+	Depth int       `json:"depth,omitempty"`
+	Size  int64     `json:"size"` // bytes on disk
+
+	Created     time.Time `json:"created"`
+	LastUsed    time.Time `json:"last_used"`
+	LastFetched time.Time `json:"last_fetched"`
+
+	InUse bool `json:"in_use"` // count of scans that read it isn't saved, it's only reported by Entries
+}
+
+// Cache keeps cloned repositories in a directory, each of them in a sub directory named by a hash
+// of it's url and clone strategy, so any url is a safe and unique path. Metadata of a repository
+// is kept in a json file next to it's directory.
+type Cache struct {
+	dir    string
+	limits CacheLimits
+
+	mu      sync.Mutex
+	entries map[string]*CacheEntry
+	users   map[string]int // count of scans that use or wait for each key
+	locks   map[string]*sync.Mutex
+}
+
+var (
+	defaultCache     *Cache
+	defaultCacheOnce sync.Once
+)
+
+// DefaultCache returns a cache in repositories directory without limits,
+// it's used when Options.Cache is nil.
+func DefaultCache() *Cache {
+	defaultCacheOnce.Do(func() {
+		defaultCache = NewCache("", CacheLimits{})
+	})
+
+	return defaultCache
+}
+
+// NewCache returns a cache in dir, repositories directory if it's empty. Repositories that were cached before
+// are loaded from it, directories that don't have a metadata file, e.g: clones of older versions, are ignored.
+func NewCache(dir string, limits CacheLimits) *Cache {
+	if dir == "" {
+		dir = reposDir
+	}
+
+	c := &Cache{
+		dir:     dir,
+		limits:  limits,
+		entries: make(map[string]*CacheEntry),
+		users:   make(map[string]int),
+		locks:   make(map[string]*sync.Mutex),
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+entryFileExt))
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		entry := &CacheEntry{}
+		if err = json.Unmarshal(b, entry); err != nil || entry.Key+entryFileExt != filepath.Base(f) {
+			continue
+		}
+		c.entries[entry.Key] = entry
+	}
+
+	return c
+}
+
+// Dir returns a directory of a cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// cacheKey returns a hex encoded sha256 of all the things that make cached repositories different,
+// access is a fingerprint of credentials a repository is cloned with, empty for public repositories.
+func cacheKey(url string, mode CloneMode, name string, depth int, access string) string {
+	parts := []string{url, string(mode), name, strconv.Itoa(depth)}
+	if access != "" {
+		parts = append(parts, access)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns a directory a repository with key is cloned to.
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// entry returns a copy of an entry of a repository with key, or nil if it isn't cached.
+func (c *Cache) entry(key string) *CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		cp := *e
+		return &cp
+	}
+
+	return nil
+}
+
+// Entries returns all cached repositories, most recently used first.
+func (c *Cache) Entries() []CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]CacheEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		e := *entry
+		e.InUse = c.users[key] > 0
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+
+	return entries
+}
+
+// Remove removes a cached repository with key, it fails with ErrCacheEntryInUse if it's being scanned.
+func (c *Cache) Remove(key string) error {
+	var op = "crud.Cache.Remove"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		return errors.Wrapf(ErrCacheEntryNotFound, "(%s): %s", op, key)
+	} else if c.users[key] > 0 {
+		return errors.Wrapf(ErrCacheEntryInUse, "(%s): %s", op, key)
+	}
+
+	if err := c.remove(key); err != nil {
+		return errors.Wrapf(err, "(%s): %s", op, key)
+	}
+
+	return nil
+}
+
+// Purge removes all cached repositories that aren't being scanned, and returns the removed ones.
+func (c *Cache) Purge() ([]CacheEntry, error) {
+	var op = "crud.Cache.Purge"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed []CacheEntry
+	for key, entry := range c.entries {
+		if c.users[key] > 0 {
+			continue
+		}
+
+		if err := c.remove(key); err != nil {
+			return removed, errors.Wrapf(err, "(%s): %s", op, key)
+		}
+		removed = append(removed, *entry)
+	}
+
+	return removed, nil
+}
+
+// Evict removes repositories that weren't used longer than MaxAge, and then least recently used ones
+// until a total size is less than MaxSize. Repositories that are being scanned are never evicted.
+func (c *Cache) Evict() ([]CacheEntry, error) {
+	var op = "crud.Cache.Evict"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*CacheEntry, 0, len(c.entries))
+	var total int64
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+		total += entry.Size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	var removed []CacheEntry
+	for _, entry := range entries {
+		expired := c.limits.MaxAge > 0 && time.Since(entry.LastUsed) > c.limits.MaxAge
+		tooBig := c.limits.MaxSize > 0 && total > c.limits.MaxSize
+		if (!expired && !tooBig) || c.users[entry.Key] > 0 {
+			continue
+		}
+
+		if err := c.remove(entry.Key); err != nil {
+			return removed, errors.Wrapf(err, "(%s): %s", op, entry.Key)
+		}
+		total -= entry.Size
+		removed = append(removed, *entry)
+	}
+
+	return removed, nil
+}
+
+// remove deletes a repository with key and it's metadata, c.mu must be held.
+func (c *Cache) remove(key string) error {
+	if err := os.RemoveAll(c.path(key)); err != nil {
+		return err
+	}
+	if err := os.Remove(c.path(key) + entryFileExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(c.entries, key)
+
+	return nil
+}
+
+// acquire pins a repository with key, so it isn't evicted or removed while a scan reads it's files,
+// and locks it, so only one scan clones or fetches it at once. It returns a copy of it's entry,
+// or nil if it isn't cached, a function that unlocks it, and a function that unpins it.
+func (c *Cache) acquire(key string) (*CacheEntry, func(), func()) {
+	c.mu.Lock()
+	c.users[key]++
+	lock, ok := c.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[key] = lock
+	}
+	c.mu.Unlock()
+
+	lock.Lock()
+
+	var once sync.Once
+	return c.entry(key), lock.Unlock, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.users[key]--
+			if c.users[key] == 0 {
+				delete(c.users, key)
+				delete(c.locks, key)
+			}
+			c.mu.Unlock()
+
+			c.Evict()
+		})
+	}
+}
+
+// shared returns true if a repository with key is pinned by more than one scan.
+func (c *Cache) shared(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.users[key] > 1
+}
+
+// save updates a size of a cached repository, and saves it's entry, it must be called by a holder of the key.
+func (c *Cache) save(entry *CacheEntry) error {
+	var op = "crud.Cache.save"
+
+	entry.Size = dirSize(c.path(entry.Key))
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrapf(err, "(%s): encoding cache entry", op)
+	}
+	if err = ioutil.WriteFile(c.path(entry.Key)+entryFileExt, b, 0644); err != nil {
+		return errors.Wrapf(err, "(%s): writing cache entry", op)
+	}
+
+	c.mu.Lock()
+	cp := *entry
+	c.entries[entry.Key] = &cp
+	c.mu.Unlock()
+
+	return nil
+}
+
+// dirSize returns a total size of files in dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
@@ -0,0 +1,341 @@
+package crud
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// CloneMode tells how a repository is cloned and kept in cache.
+type CloneMode string
+
+// Clone modes of CloneStrategy.
+const (
+	CloneFull         CloneMode = "full"          // all branches and tags with a checked out worktree, default
+	CloneBare         CloneMode = "bare"          // all branches and tags without a worktree
+	CloneShallow      CloneMode = "shallow"       // only the requested branch or tag, and only it's last Depth commits
+	CloneSingleBranch CloneMode = "single-branch" // only the requested branch or tag, with all of it's history
+	CloneMemory       CloneMode = "memory"        // nothing is written on disk, for one-shot scans
+)
+
+// defaultDepth is a count of commits in a shallow clone if CloneStrategy doesn't set it.
+const defaultDepth = 1
+
+// CloneStrategy tells how a repository is cloned, zero value means a full clone.
+// Shallow and single-branch clones are only made when a branch or a tag is scanned,
+// for hashes they fall back to bare clones, since a commit can be anywhere in a repository.
+type CloneStrategy struct {
+	Mode  CloneMode `json:"mode"`
+	Depth int       `json:"depth"` // count of commits in a shallow clone, memory clones are shallow too if it's set
+}
+
+// Validate returns an error if a mode of s is unknown or it's depth is negative.
+func (s CloneStrategy) Validate() error {
+	var op = "crud.CloneStrategy.Validate"
+
+	switch s.Mode {
+	case "", CloneFull, CloneBare, CloneShallow, CloneSingleBranch, CloneMemory:
+	default:
+		return errors.Errorf("(%s): unknown clone mode %q, must be full, bare, shallow, single-branch or memory", op, s.Mode)
+	}
+
+	if s.Depth < 0 {
+		return errors.Errorf("(%s): depth can't be negative", op)
+	}
+
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, a strategy is decoded from an object,
+// or from a string that is just a mode, e.g: "bare".
+func (s *CloneStrategy) UnmarshalJSON(b []byte) error {
+	// plain doesn't have UnmarshalJSON method, so decoding it doesn't recurse
+	type plain CloneStrategy
+
+	var st plain
+	if err := json.Unmarshal(b, &st.Mode); err != nil {
+		if err = json.Unmarshal(b, &st); err != nil {
+			return err
+		}
+	}
+
+	if err := CloneStrategy(st).Validate(); err != nil {
+		return err
+	}
+	*s = CloneStrategy(st)
+
+	return nil
+}
+
+// clonePlan is a CloneStrategy applied to a scan of a single repository revision.
+type clonePlan struct {
+	mode  CloneMode
+	url   string
+	depth int
+
+	name string                 // a branch or a tag that is cloned alone, e.g: main, empty if all of them are cloned
+	ref  plumbing.ReferenceName // full name of the branch or tag
+	key  string                 // key of a repository in cache, empty in memory mode
+	path string                 // directory a repository is cached in, empty in memory mode
+
+	access string // fingerprint of credentials, repositories cloned with other credentials aren't reused
+}
+
+// newClonePlan decides how url is cloned to scan rev. A remote is only asked for it's references
+// when a single branch or tag is cloned and it isn't cached yet.
+func newClonePlan(url, rev string, s CloneStrategy, auth transport.AuthMethod, access string, cache *Cache) (*clonePlan, error) {
+	var op = "crud.newClonePlan"
+
+	p := &clonePlan{
+		mode:   s.Mode,
+		url:    url,
+		depth:  s.Depth,
+		access: access,
+	}
+	if p.mode == "" {
+		p.mode = CloneFull
+	} else if p.mode == CloneShallow && p.depth == 0 {
+		p.depth = defaultDepth
+	}
+
+	base, suffix := revisionBase(rev)
+	if suffix != "" && p.depth > 0 {
+		// an expression like main~3 can point behind the last commits of a shallow clone
+		p.depth = 0
+		if p.mode == CloneShallow {
+			p.mode = CloneSingleBranch
+		}
+	}
+
+	if p.mode == CloneShallow || p.mode == CloneSingleBranch || (p.mode == CloneMemory && p.depth > 0) {
+		p.name = strings.TrimPrefix(base, remoteName+"/")
+		if p.name == "" {
+			p.name = plumbing.HEAD.String()
+		}
+
+		if entry := cache.entry(p.cacheKey()); entry != nil && p.mode != CloneMemory {
+			p.ref = plumbing.ReferenceName(entry.Ref)
+		} else if err := p.resolveReference(auth); err != nil {
+			return nil, errors.Wrapf(err, "(%s): listing remote references", op)
+		}
+	}
+
+	if p.mode != CloneMemory {
+		p.key = p.cacheKey()
+		p.path = cache.path(p.key)
+	}
+
+	return p, nil
+}
+
+// resolveReference asks a remote for a full name of the branch or tag that is cloned alone,
+// if there is no such branch or tag, a plan falls back to clone the whole repository.
+func (p *clonePlan) resolveReference(auth transport.AuthMethod) error {
+	ref, err := remoteReference(p.url, p.name, auth)
+	if err != nil {
+		return err
+	}
+
+	// rev is a hash, it's only found in a whole repository
+	if ref == "" {
+		p.name = ""
+		p.depth = 0
+		if p.mode != CloneMemory {
+			p.mode = CloneBare
+		}
+	}
+	p.ref = ref
+
+	return nil
+}
+
+// cacheKey returns a key of a repository in cache, each mode and each single branch or tag
+// is kept separately, since they hold different objects.
+func (p *clonePlan) cacheKey() string {
+	return cacheKey(p.url, p.mode, p.name, p.depth, p.access)
+}
+
+// clone clones a repository according to a plan.
+func (p *clonePlan) clone(ctx context.Context, auth transport.AuthMethod, progress ProgressFunc) (*git.Repository, error) {
+	o := &git.CloneOptions{
+		URL:      p.url,
+		Auth:     auth,
+		Depth:    p.depth,
+		Progress: &progressWriter{progress: progress},
+	}
+	if p.ref != "" {
+		o.ReferenceName = p.ref
+		o.SingleBranch = true
+	}
+	if p.depth > 0 {
+		o.Tags = git.NoTags
+	}
+
+	switch p.mode {
+	case CloneMemory:
+		return git.CloneContext(ctx, memory.NewStorage(), nil, o)
+	case CloneFull:
+		return git.PlainCloneContext(ctx, p.path, false, o)
+	default:
+		return git.PlainCloneContext(ctx, p.path, true, o)
+	}
+}
+
+// fetchOptions returns options that update a cached clone.
+func (p *clonePlan) fetchOptions(auth transport.AuthMethod, progress ProgressFunc) *git.FetchOptions {
+	o := &git.FetchOptions{
+		RemoteName: remoteName,
+		Force:      true,
+		Auth:       auth,
+		Progress:   &progressWriter{progress: progress},
+	}
+
+	// refspecs of a single branch or tag are saved in remote config when it's cloned
+	if p.name == "" {
+		o.RefSpecs = fetchRefSpecs
+		o.Tags = git.AllTags
+	}
+
+	return o
+}
+
+// remoteReference returns a full name of a branch or a tag on a remote of url that name refers to,
+// branches take precedence over tags like in resolveRevision, HEAD is the default branch.
+// It returns an empty name if there is no such branch or tag.
+func remoteReference(url, name string, auth transport.AuthMethod) (plumbing.ReferenceName, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: remoteName,
+		URLs: []string{url},
+	})
+
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+
+	if name == plumbing.HEAD.String() {
+		head, ok := byName[plumbing.HEAD]
+		if !ok || head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+			return "", nil
+		}
+
+		return head.Target(), nil
+	}
+
+	for _, c := range []plumbing.ReferenceName{
+		plumbing.NewBranchReferenceName(name),
+		plumbing.NewTagReferenceName(name),
+		plumbing.ReferenceName(name), // a full name, e.g: refs/heads/main
+	} {
+		if _, ok := byName[c]; ok && (c.IsBranch() || c.IsTag()) {
+			return c, nil
+		}
+	}
+
+	return "", nil
+}
+
+// openRepository clones a repository for a scan of rev according to s, or opens it if it's in cache,
+// and fetches it according to policy. It returns the time repository was last fetched, and a function
+// that must be called when a scan doesn't read files of repository anymore, so it can be evicted again.
+// access is a fingerprint of credentials, a cached repository is only reused with the same credentials.
+func openRepository(ctx context.Context, url, rev string, s CloneStrategy, policy FetchPolicy, auth transport.AuthMethod, access string, cache *Cache, progress ProgressFunc) (*git.Repository, time.Time, func(), error) {
+	var op = "crud.openRepository"
+
+	p, err := newClonePlan(url, rev, s, auth, access, cache)
+	if err != nil {
+		return nil, time.Time{}, nil, errors.Wrapf(err, "(%s): planning a clone", op)
+	}
+
+	if p.mode == CloneMemory {
+		r, err := p.clone(ctx, auth, progress)
+		if err != nil {
+			return nil, time.Time{}, nil, errors.Wrapf(err, "(%s): cloning a git repo", op)
+		}
+
+		return r, time.Now(), func() {}, nil
+	}
+
+	entry, unlock, release := cache.acquire(p.key)
+	r, fetched, err := p.openCached(ctx, entry, policy, auth, cache, progress)
+	unlock()
+	if err != nil {
+		release()
+		return nil, time.Time{}, nil, errors.Wrapf(err, "(%s): %s", op, url)
+	}
+
+	return r, fetched, release, nil
+}
+
+// openCached opens a repository from entry and fetches it according to policy, or clones it
+// if entry is nil. The key of a plan must be held. entry is updated and saved in cache,
+// the time repository was last fetched is returned.
+func (p *clonePlan) openCached(ctx context.Context, entry *CacheEntry, policy FetchPolicy, auth transport.AuthMethod, cache *Cache, progress ProgressFunc) (*git.Repository, time.Time, error) {
+	var op = "crud.openCached"
+
+	now := time.Now()
+	if entry != nil {
+		entry.LastUsed = now
+
+		// a shallow clone is cheaper to make again than to update, and go-git can't deepen it,
+		// but it's kept as it is while other scans read it's files
+		reclone := p.mode == CloneShallow && policy.needsFetch(entry.LastFetched)
+		if reclone && cache.shared(p.key) {
+			reclone = false
+			policy = FetchPolicy{Mode: FetchNever}
+		}
+
+		if !reclone {
+			r, err := git.PlainOpen(p.path)
+			if err != nil {
+				return nil, time.Time{}, errors.Wrapf(err, "(%s): opening a git repo", op)
+			}
+
+			entry.LastFetched, err = fetch(ctx, r, entry.LastFetched, policy, p.fetchOptions(auth, progress))
+			if err != nil {
+				return nil, time.Time{}, errors.Wrapf(err, "(%s): refreshing a git repo", op)
+			}
+
+			return r, entry.LastFetched, cache.save(entry)
+		}
+	} else {
+		entry = &CacheEntry{
+			Key:     p.key,
+			URL:     p.url,
+			Mode:    p.mode,
+			Ref:     p.ref.String(),
+			Depth:   p.depth,
+			Created: now,
+		}
+	}
+
+	// a directory without an entry is left by a crash, or by an older version of a cache
+	if err := os.RemoveAll(p.path); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "(%s): removing an outdated clone", op)
+	}
+
+	r, err := p.clone(ctx, auth, progress)
+	if err != nil {
+		os.RemoveAll(p.path) // don't leave a partial clone, e.g: when cloning was canceled
+
+		return nil, time.Time{}, errors.Wrapf(err, "(%s): cloning a git repo", op)
+	}
+
+	entry.LastUsed = now
+	entry.LastFetched = now
+
+	return r, entry.LastFetched, cache.save(entry)
+}
@@ -0,0 +1,116 @@
+package crud
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+)
+
+// FetchMode tells when a cached repository is fetched from it's remote before it's scanned.
+type FetchMode string
+
+// Fetch modes of FetchPolicy.
+const (
+	FetchAlways  FetchMode = "always"
+	FetchIfOlder FetchMode = "if-older"
+	FetchNever   FetchMode = "never"
+)
+
+// fetchRefSpecs fetch all branches and tags, and overwrite local ones even if a branch was force-pushed.
+var fetchRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/remotes/" + remoteName + "/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// FetchPolicy tells when a cached repository is fetched from it's remote before it's scanned,
+// zero value means always.
+type FetchPolicy struct {
+	Mode   FetchMode
+	MaxAge time.Duration // repository is fetched if it was fetched longer than MaxAge ago, used by FetchIfOlder
+}
+
+// ParseFetchPolicy parses a fetch policy from "always", "never" or a duration, e.g: "30m",
+// which means fetch if repository was fetched longer than 30 minutes ago. Empty string means always.
+func ParseFetchPolicy(s string) (FetchPolicy, error) {
+	var op = "crud.ParseFetchPolicy"
+
+	switch FetchMode(strings.TrimSpace(s)) {
+	case "", FetchAlways:
+		return FetchPolicy{Mode: FetchAlways}, nil
+	case FetchNever:
+		return FetchPolicy{Mode: FetchNever}, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return FetchPolicy{}, errors.Wrapf(err, "(%s): fetch policy must be always, never or a duration", op)
+	}
+
+	return FetchPolicy{Mode: FetchIfOlder, MaxAge: d}, nil
+}
+
+// String returns a policy in the same form ParseFetchPolicy accepts.
+func (p FetchPolicy) String() string {
+	if p.Mode == FetchIfOlder {
+		return p.MaxAge.String()
+	} else if p.Mode == "" {
+		return string(FetchAlways)
+	}
+
+	return string(p.Mode)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, a policy is decoded from a string accepted by ParseFetchPolicy.
+func (p *FetchPolicy) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	policy, err := ParseFetchPolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = policy
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p FetchPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// needsFetch returns true if a repository that was last fetched at fetched should be fetched now.
+func (p FetchPolicy) needsFetch(fetched time.Time) bool {
+	switch p.Mode {
+	case FetchNever:
+		return false
+	case FetchIfOlder:
+		return time.Since(fetched) > p.MaxAge
+	default:
+		return true
+	}
+}
+
+// fetch updates a cached repository that was last fetched at fetched with o according to policy,
+// it returns the time repository was last fetched.
+func fetch(ctx context.Context, r *git.Repository, fetched time.Time, policy FetchPolicy, o *git.FetchOptions) (time.Time, error) {
+	var op = "crud.fetch"
+
+	if !policy.needsFetch(fetched) {
+		return fetched, nil
+	}
+
+	now := time.Now()
+	err := r.FetchContext(ctx, o)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fetched, errors.Wrapf(err, "(%s): fetching from %s", op, o.RemoteName)
+	}
+
+	return now, nil
+}
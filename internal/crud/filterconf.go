@@ -0,0 +1,377 @@
+package crud
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Formats of filter configs.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// FilterConfig is a set of filter rules, as it's written in a json, yaml or toml file.
+type FilterConfig struct {
+	Config  []Config `json:"config"`
+	Exclude []string `json:"exclude,omitempty"` // optional, glob patterns of files no rule matches
+
+	// FirstMatch tells to match each file only by the first rule it matches, optional.
+	FirstMatch bool `json:"first_match,omitempty"`
+
+	// Namespace is a package of policies deny, warn and violation rules are evaluated in, main by default.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Options returns filter options of a config.
+func (c *FilterConfig) Options() *FilterOptions {
+	return &FilterOptions{Exclude: c.Exclude, FirstMatch: c.FirstMatch, Namespace: c.Namespace}
+}
+
+// ConfigError is an error at a position of a filter config, line and column start from 1,
+// they are 0 if a position isn't known.
+type ConfigError struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Field   string `json:"field,omitempty"` // dot separated path of a field, e.g: config.0.glob
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&b, ", column %d", e.Column)
+		}
+		b.WriteString(": ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Message)
+
+	return b.String()
+}
+
+// ConfigErrors are all errors of a filter config, in order they appear in it.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// DetectFormat returns a format of a filter config by a content type, or by an extension of a file name
+// if a content type is empty or generic. If neither tells it, content that starts with { is json, and yaml otherwise.
+func DetectFormat(name, contentType string, content []byte) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mt {
+		case "application/json", "text/json":
+			return FormatJSON
+		case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+			return FormatYAML
+		case "application/toml", "text/toml", "text/x-toml":
+			return FormatTOML
+		}
+	}
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		return FormatJSON
+	}
+
+	return FormatYAML
+}
+
+// ParseFilterConfig decodes a filter config in a format, validates it against FilterSchema,
+// and checks regexps and patterns of it's rules. Invalid configs are reported as ConfigErrors
+// with lines and columns of invalid fields.
+func ParseFilterConfig(content []byte, format string) (*FilterConfig, error) {
+	var op = "crud.ParseFilterConfig"
+
+	var (
+		doc       interface{}
+		positions map[string]ConfigError
+		err       error
+	)
+	switch format {
+	case FormatJSON:
+		doc, positions, err = decodeJSON(content)
+	case FormatYAML:
+		doc, positions, err = decodeYAML(content)
+	case FormatTOML:
+		doc, positions, err = decodeTOML(content)
+	default:
+		return nil, errors.Errorf("(%s): unknown format %q, must be %s, %s or %s", op, format, FormatJSON, FormatYAML, FormatTOML)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := filterSchema()
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): loading a filter schema", op)
+	}
+	res, err := schema.Validate(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): validating a config", op)
+	}
+
+	var errs ConfigErrors
+	for _, e := range res.Errors() {
+		field := e.Field()
+		if field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+			field = ""
+		}
+		if p, ok := e.Details()["property"].(string); ok && e.Type() == "additional_property_not_allowed" {
+			field = joinField(field, p)
+		}
+		// some descriptions start with a field, it's already reported separately
+		msg := strings.TrimPrefix(e.Description(), e.Field()+" ")
+		errs = append(errs, at(positions, field, msg))
+	}
+	if len(errs) > 0 {
+		return nil, sortErrors(errs)
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): encoding a config", op)
+	}
+	conf := &FilterConfig{}
+	if err = json.Unmarshal(b, conf); err != nil {
+		return nil, errors.Wrapf(err, "(%s): decoding a config", op)
+	}
+
+	// regexps and patterns can't be checked by a schema
+	for i, c := range conf.Config {
+		if _, err := newRule(c); err != nil {
+			errs = append(errs, at(positions, errorField("config."+strconv.Itoa(i), err), fmt.Sprintf("invalid %s rule: %s", c.Name, err)))
+		}
+	}
+	if _, err := newGlobs(conf.Exclude); err != nil {
+		errs = append(errs, at(positions, errorField("exclude", err), err.Error()))
+	}
+	if len(errs) > 0 {
+		return nil, sortErrors(errs)
+	}
+
+	return conf, nil
+}
+
+var (
+	filterSchemaOnce sync.Once
+	filterSchemaVal  *gojsonschema.Schema
+	filterSchemaErr  error
+)
+
+// filterSchema compiles FilterSchema once.
+func filterSchema() (*gojsonschema.Schema, error) {
+	filterSchemaOnce.Do(func() {
+		filterSchemaVal, filterSchemaErr = gojsonschema.NewSchema(gojsonschema.NewStringLoader(FilterSchema))
+	})
+
+	return filterSchemaVal, filterSchemaErr
+}
+
+// errorField returns a field an error of a field is about, e.g: config.0.glob.1, it's field itself if an error
+// isn't a fieldError.
+func errorField(field string, err error) string {
+	if fe, ok := err.(*fieldError); ok {
+		return joinField(field, fe.field)
+	}
+
+	return field
+}
+
+// at returns an error of a field at it's position, or at a position of it's closest parent that is known.
+func at(positions map[string]ConfigError, field, msg string) ConfigError {
+	for f := field; ; {
+		if p, ok := positions[f]; ok {
+			return ConfigError{Line: p.Line, Column: p.Column, Field: field, Message: msg}
+		}
+		i := strings.LastIndex(f, ".")
+		if i < 0 {
+			break
+		}
+		f = f[:i]
+	}
+
+	return ConfigError{Field: field, Message: msg}
+}
+
+// sortErrors sorts errors by their positions.
+func sortErrors(errs ConfigErrors) ConfigErrors {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Column < errs[j].Column
+	})
+
+	return errs
+}
+
+// joinField appends a key to a dot separated path of a field.
+func joinField(field, key string) string {
+	if field == "" {
+		return key
+	}
+
+	return field + "." + key
+}
+
+// decodeJSON decodes a json config, syntax errors are reported at their line and column.
+func decodeJSON(content []byte) (interface{}, map[string]ConfigError, error) {
+	var doc interface{}
+	if err := stdjson.Unmarshal(content, &doc); err != nil {
+		var offset int64
+		switch e := err.(type) {
+		case *stdjson.SyntaxError:
+			offset = e.Offset - 1 // an offset is after an invalid character
+		case *stdjson.UnmarshalTypeError:
+			offset = e.Offset
+		default:
+			return nil, nil, ConfigErrors{{Message: err.Error()}}
+		}
+		line, col := position(content, offset)
+		return nil, nil, ConfigErrors{{Line: line, Column: col, Message: err.Error()}}
+	}
+
+	// json is yaml too, so positions of valid json are taken from yaml nodes
+	_, positions, err := decodeYAML(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return doc, positions, nil
+}
+
+// position returns a line and a column of a byte offset in content.
+func position(content []byte, offset int64) (line, col int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	} else if offset < 0 {
+		offset = 0
+	}
+	before := content[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = len(before) - bytes.LastIndexByte(before, '\n')
+
+	return line, col
+}
+
+// decodeYAML decodes a yaml config, syntax errors have a line only, since yaml parser doesn't report a column.
+func decodeYAML(content []byte) (interface{}, map[string]ConfigError, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(content, &node); err != nil {
+		if te, ok := err.(*yaml.TypeError); ok {
+			err = errors.New(strings.Join(te.Errors, "; "))
+		}
+		msg := strings.TrimPrefix(err.Error(), "yaml: ")
+
+		var line int
+		if _, scanErr := fmt.Sscanf(msg, "line %d:", &line); scanErr == nil {
+			msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+		}
+		return nil, nil, ConfigErrors{{Line: line, Message: msg}}
+	}
+
+	var doc interface{}
+	if err := node.Decode(&doc); err != nil {
+		return nil, nil, ConfigErrors{{Line: node.Line, Column: node.Column, Message: err.Error()}}
+	}
+
+	positions := make(map[string]ConfigError)
+	if len(node.Content) > 0 {
+		yamlPositions(node.Content[0], "", positions)
+	}
+
+	return doc, positions, nil
+}
+
+// yamlPositions saves positions of a node and all of it's children by their fields,
+// a field of a mapping value is at it's key.
+func yamlPositions(node *yaml.Node, field string, positions map[string]ConfigError) {
+	positions[field] = ConfigError{Line: node.Line, Column: node.Column}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			f := joinField(field, key.Value)
+			yamlPositions(value, f, positions)
+			positions[f] = ConfigError{Line: key.Line, Column: key.Column}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			yamlPositions(item, joinField(field, strconv.Itoa(i)), positions)
+		}
+	}
+}
+
+// decodeTOML decodes a toml config, rules are written as an array of tables, e.g: [[config]].
+func decodeTOML(content []byte) (interface{}, map[string]ConfigError, error) {
+	tree, err := toml.LoadBytes(content)
+	if err != nil {
+		// go-toml reports errors as "(line, column): message"
+		var line, col int
+		msg := err.Error()
+		if _, scanErr := fmt.Sscanf(msg, "(%d, %d):", &line, &col); scanErr == nil {
+			msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+		}
+		return nil, nil, ConfigErrors{{Line: line, Column: col, Message: msg}}
+	}
+
+	positions := make(map[string]ConfigError)
+	tomlPositions(tree, "", positions)
+
+	return tree.ToMap(), positions, nil
+}
+
+// tomlPositions saves positions of keys of a tree and of all it's sub trees by their fields.
+func tomlPositions(tree *toml.Tree, field string, positions map[string]ConfigError) {
+	pos := tree.Position()
+	positions[field] = ConfigError{Line: pos.Line, Column: pos.Col}
+
+	for _, key := range tree.Keys() {
+		f := joinField(field, key)
+		pos := tree.GetPositionPath([]string{key})
+		positions[f] = ConfigError{Line: pos.Line, Column: pos.Col}
+
+		switch v := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			tomlPositions(v, f, positions)
+		case []*toml.Tree:
+			for i, t := range v {
+				tomlPositions(t, joinField(f, strconv.Itoa(i)), positions)
+			}
+		}
+	}
+}
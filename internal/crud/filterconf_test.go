@@ -0,0 +1,372 @@
+package crud
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConfigPositions(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    map[string]string // field: line:column
+	}{
+		{
+			name:   "yaml block",
+			format: FormatYAML,
+			content: `config:
+- name: k8s
+  glob:
+    - "*.yaml"
+  content:
+    values:
+      kind: Deployment
+`,
+			want: map[string]string{
+				"":                             "1:1",
+				"config":                       "1:1",
+				"config.0":                     "2:3",
+				"config.0.name":                "2:3",
+				"config.0.glob":                "3:3",
+				"config.0.glob.0":              "4:7",
+				"config.0.content.values.kind": "7:7",
+			},
+		},
+		{
+			name:   "yaml flow",
+			format: FormatYAML,
+			content: `exclude: [vendor/, "!keep"]
+config: [{name: tf, glob: ["*.tf"]}]
+`,
+			want: map[string]string{
+				"exclude.0":       "1:11",
+				"exclude.1":       "1:20",
+				"config.0":        "2:10",
+				"config.0.name":   "2:11",
+				"config.0.glob":   "2:21",
+				"config.0.glob.0": "2:28",
+			},
+		},
+		{
+			name:   "json",
+			format: FormatJSON,
+			content: `{
+  "config": [
+    {"name": "tf",
+     "glob": ["*.tf"]}
+  ]
+}`,
+			want: map[string]string{
+				"":                "1:1",
+				"config":          "2:3",
+				"config.0":        "3:5",
+				"config.0.name":   "3:6",
+				"config.0.glob":   "4:6",
+				"config.0.glob.0": "4:15",
+			},
+		},
+		{
+			name:   "toml",
+			format: FormatTOML,
+			content: `exclude = ["vendor/"]
+
+[[config]]
+name = "tf"
+glob = ["*.tf"]
+`,
+			want: map[string]string{
+				"exclude":       "1:1",
+				"config":        "3:1",
+				"config.0.name": "4:1",
+				"config.0.glob": "5:1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var positions map[string]ConfigError
+			var err error
+			switch tt.format {
+			case FormatYAML:
+				_, positions, err = decodeYAML([]byte(tt.content))
+			case FormatJSON:
+				_, positions, err = decodeJSON([]byte(tt.content))
+			case FormatTOML:
+				_, positions, err = decodeTOML([]byte(tt.content))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for field, want := range tt.want {
+				p, ok := positions[field]
+				if !ok {
+					t.Errorf("%q: no position", field)
+				} else if got := fmt.Sprintf("%d:%d", p.Line, p.Column); got != want {
+					t.Errorf("%q: got %s, want %s", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilterConfigErrorPositions(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    []ConfigError // only positions and fields are compared
+	}{
+		{
+			name:   "yaml syntax",
+			format: FormatYAML,
+			content: `config:
+- name: a
+  glob: ["*.go"
+`,
+			want: []ConfigError{{Line: 2}},
+		},
+		{
+			name:    "json syntax",
+			format:  FormatJSON,
+			content: "{\n  \"config\": [,]\n}",
+			want:    []ConfigError{{Line: 2, Column: 14}},
+		},
+		{
+			name:    "empty json",
+			format:  FormatJSON,
+			content: "",
+			want:    []ConfigError{{Line: 1, Column: 1}},
+		},
+		{
+			name:   "schema type",
+			format: FormatYAML,
+			content: `config:
+- name: a
+  glob: "*.go"
+`,
+			want: []ConfigError{{Line: 3, Column: 3, Field: "config.0.glob"}},
+		},
+		{
+			name:   "schema additional property",
+			format: FormatJSON,
+			content: `{"config": [{"name": "a", "glob": ["*.go"],
+  "bogus": 1}]}`,
+			want: []ConfigError{{Line: 2, Column: 3, Field: "config.0.bogus"}},
+		},
+		{
+			name:   "content regexp",
+			format: FormatYAML,
+			content: `config:
+- name: a
+  glob: ["*.yaml"]
+  content:
+    regexp: "(kind"
+`,
+			want: []ConfigError{{Line: 5, Column: 5, Field: "config.0.content.regexp"}},
+		},
+		{
+			name:    "glob pattern in flow yaml",
+			format:  FormatYAML,
+			content: `config: [{name: a, glob: ["*.go", "a**b"]}]`,
+			want:    []ConfigError{{Line: 1, Column: 35, Field: "config.0.glob.1"}},
+		},
+		{
+			name:   "exclude of a type",
+			format: FormatTOML,
+			content: `[[config]]
+name = "k8s"
+type = "kubernetes"
+exclude = ["ok/", ""]
+`,
+			want: []ConfigError{{Line: 4, Column: 1, Field: "config.0.exclude.1"}},
+		},
+		{
+			name:    "top level exclude",
+			format:  FormatJSON,
+			content: `{"exclude": ["/"], "config": [{"name": "a", "glob": ["*"]}]}`,
+			want:    []ConfigError{{Line: 1, Column: 14, Field: "exclude.0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFilterConfig([]byte(tt.content), tt.format)
+			errs, ok := err.(ConfigErrors)
+			if !ok {
+				t.Fatalf("got %v, want ConfigErrors", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got %d errors (%v), want %d", len(errs), errs, len(tt.want))
+			}
+
+			for i, want := range tt.want {
+				got := errs[i]
+				if got.Line != want.Line || got.Column != want.Column || got.Field != want.Field {
+					t.Errorf("got %d:%d %q (%s), want %d:%d %q", got.Line, got.Column, got.Field, got.Message, want.Line, want.Column, want.Field)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilterConfig(t *testing.T) {
+	want := &FilterConfig{
+		Config: []Config{
+			{Name: "k8s", Type: "kubernetes", Exclude: []string{"test/"}},
+			{Name: "tf", Glob: []string{"*.tf"}, PolicyURL: "https://example.com/tf.rego", Content: &ContentMatcher{Values: map[string]string{"kind": "Deployment"}}},
+		},
+		Exclude:    []string{"vendor/"},
+		FirstMatch: true,
+		Namespace:  "policies",
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		content string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			content: `{
+  "exclude": ["vendor/"],
+  "first_match": true,
+  "namespace": "policies",
+  "config": [
+    {"name": "k8s", "type": "kubernetes", "exclude": ["test/"]},
+    {"name": "tf", "glob": ["*.tf"], "policy": "https://example.com/tf.rego", "content": {"values": {"kind": "Deployment"}}}
+  ]
+}`,
+		},
+		{
+			name:   "yaml",
+			format: FormatYAML,
+			content: `exclude: [vendor/]
+first_match: true
+namespace: policies
+config:
+- name: k8s
+  type: kubernetes
+  exclude: [test/]
+- name: tf
+  glob: ["*.tf"]
+  policy: https://example.com/tf.rego
+  content:
+    values:
+      kind: Deployment
+`,
+		},
+		{
+			name:   "toml",
+			format: FormatTOML,
+			content: `exclude = ["vendor/"]
+first_match = true
+namespace = "policies"
+
+[[config]]
+name = "k8s"
+type = "kubernetes"
+exclude = ["test/"]
+
+[[config]]
+name = "tf"
+glob = ["*.tf"]
+policy = "https://example.com/tf.rego"
+[config.content.values]
+kind = "Deployment"
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilterConfig([]byte(tt.content), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseFilterConfigSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    []string // fields of errors, in order
+	}{
+		{name: "no config", format: FormatJSON, content: `{}`, want: []string{""}},
+		{name: "no name", format: FormatJSON, content: `{"config": [{"glob": ["*"]}]}`, want: []string{"config.0"}},
+		{name: "unknown type", format: FormatYAML, content: "config:\n- name: a\n  type: dockerfile\n", want: []string{"config.0.type"}},
+		{name: "unknown field", format: FormatTOML, content: "[[config]]\nname = \"a\"\nglobs = [\"*\"]\n", want: []string{"config.0.globs"}},
+		{
+			name:    "several errors",
+			format:  FormatYAML,
+			content: "first_match: yes please\nconfig:\n- name: a\n  glob: \"*\"\n",
+			want:    []string{"first_match", "config.0.glob"},
+		},
+		{name: "invalid regexp", format: FormatJSON, content: `{"config": [{"name": "a", "filter": "("}]}`, want: []string{"config.0.filter"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFilterConfig([]byte(tt.content), tt.format)
+			errs, ok := err.(ConfigErrors)
+			if !ok {
+				t.Fatalf("got %v, want ConfigErrors", err)
+			}
+
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got fields %q (%v), want %q", got, errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterConfigUnknownFormat(t *testing.T) {
+	if _, err := ParseFilterConfig([]byte(`{"config": []}`), "xml"); err == nil {
+		t.Fatal("got no error")
+	} else if _, ok := err.(ConfigErrors); ok {
+		t.Fatalf("got ConfigErrors %v, want an error of a format", err)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		contentType string
+		content     string
+		want        string
+	}{
+		{name: "json content type", contentType: "application/json; charset=utf-8", content: "a: 1", want: FormatJSON},
+		{name: "yaml content type", contentType: "application/x-yaml", content: "{}", want: FormatYAML},
+		{name: "toml content type", contentType: "text/toml", want: FormatTOML},
+		{name: "content type over extension", file: "rules.json", contentType: "application/toml", want: FormatTOML},
+		{name: "generic content type", file: "rules.toml", contentType: "application/octet-stream", want: FormatTOML},
+		{name: "json extension", file: "rules.JSON", want: FormatJSON},
+		{name: "yml extension", file: ".gitfilter.yml", want: FormatYAML},
+		{name: "json content", file: "rules", content: "\n  {\"config\": []}", want: FormatJSON},
+		{name: "yaml content", content: "config: []", want: FormatYAML},
+		{name: "empty", want: FormatYAML},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat(tt.file, tt.contentType, []byte(tt.content)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
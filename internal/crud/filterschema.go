@@ -0,0 +1,150 @@
+package crud
+
+// FilterSchema is a json schema filter configs are validated against, it's served by api too,
+// so editors can use it for completion.
+const FilterSchema = `{
+    "$schema": "http://json-schema.org/draft-07/schema#",
+    "$id": "/api/v1/filter.schema.json",
+    "title": "Filter config",
+    "description": "Rules that select files of a scanned repository and policies applied to them",
+    "type": "object",
+    "required": [
+        "config"
+    ],
+    "additionalProperties": false,
+    "properties": {
+        "config": {
+            "type": "array",
+            "minItems": 1,
+            "items": {
+                "$ref": "#/definitions/rule"
+            }
+        },
+        "exclude": {
+            "type": "array",
+            "items": {
+                "type": "string",
+                "minLength": 1
+            },
+            "description": "Gitignore style patterns of files no rule matches"
+        },
+        "first_match": {
+            "type": "boolean",
+            "description": "Match each file only by the first rule it matches, in order of config, by default a file is matched by all of them"
+        },
+        "namespace": {
+            "type": "string",
+            "pattern": "^[A-Za-z_][A-Za-z0-9_]*(\\.[A-Za-z_][A-Za-z0-9_]*)*$",
+            "description": "Package of policies deny, warn and violation rules are evaluated in, main by default"
+        }
+    },
+    "definitions": {
+        "rule": {
+            "type": "object",
+            "required": [
+                "name"
+            ],
+            "additionalProperties": false,
+            "properties": {
+                "name": {
+                    "type": "string",
+                    "minLength": 1,
+                    "description": "Name of a rule, it's a type of files that match it"
+                },
+                "filter": {
+                    "type": "string",
+                    "description": "Regexp matched against file names"
+                },
+                "glob": {
+                    "type": "array",
+                    "items": {
+                        "type": "string",
+                        "minLength": 1
+                    },
+                    "description": "Gitignore style patterns matched against file names, an alternative to filter"
+                },
+                "exclude": {
+                    "type": "array",
+                    "items": {
+                        "type": "string",
+                        "minLength": 1
+                    },
+                    "description": "Gitignore style patterns of files a rule skips"
+                },
+                "policy": {
+                    "type": "string",
+                    "description": "Url of a rego module or an OPA bundle tarball, or a git source, e.g: git::https://github.com/org/policies//k8s?ref=v1.2.0, a path on disk only in cli"
+                },
+                "attributes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string",
+                        "pattern": "^!?(binary|vendored|generated|documentation|configuration|test)$"
+                    },
+                    "description": "Attributes files must have, a leading ! means files must not have it"
+                },
+                "content": {
+                    "$ref": "#/definitions/content"
+                },
+                "match": {
+                    "type": "string",
+                    "enum": [
+                        "all",
+                        "any"
+                    ],
+                    "description": "How filter or glob and content are combined"
+                },
+                "type": {
+                    "type": "string",
+                    "enum": [
+                        "ansible",
+                        "cloudformation",
+                        "docker-compose",
+                        "github-actions",
+                        "gitlab-ci",
+                        "helm",
+                        "kubernetes",
+                        "kustomize",
+                        "terraform"
+                    ],
+                    "description": "Built-in file type a rule matches instead of filter, glob and content, they are listed by /api/v1/types"
+                },
+                "namespace": {
+                    "type": "string",
+                    "pattern": "^[A-Za-z_][A-Za-z0-9_]*(\\.[A-Za-z_][A-Za-z0-9_]*)*$",
+                    "description": "Package of a policy of this rule, overrides a top level namespace"
+                }
+            }
+        },
+        "content": {
+            "type": "object",
+            "additionalProperties": false,
+            "properties": {
+                "regexp": {
+                    "type": "string",
+                    "description": "Regexp matched against a whole content"
+                },
+                "keys": {
+                    "type": "array",
+                    "items": {
+                        "type": "string",
+                        "minLength": 1
+                    },
+                    "description": "Keys a json or yaml document must have, nested keys are separated by dots"
+                },
+                "values": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    },
+                    "description": "Keys a json or yaml document must have with given values"
+                },
+                "shebang": {
+                    "type": "string",
+                    "description": "Regexp matched against the first line without #!"
+                }
+            }
+        }
+    }
+}
+`
@@ -1,28 +1,25 @@
 package crud
 
 import (
+	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/open-policy-agent/opa/rego"
 
 	"github.com/bejaneps/go-git-webapp/internal/util"
 	"github.com/pkg/errors"
-	"gopkg.in/src-d/go-git.v4/plumbing"
-
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
 
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
 
-	enry "github.com/src-d/enry/v2"
+	enry "github.com/go-enry/go-enry/v2"
 )
 
 var (
@@ -30,8 +27,17 @@ var (
 )
 
 var (
-	reposDir      = "repositories"
-	defaultPolicy = filepath.Join("config", "default.rego")
+	reposDir = "repositories"
+)
+
+// DefaultMaxBlobSize is a size of the largest file which content is read, if Options.MaxBlobSize isn't set.
+const DefaultMaxBlobSize = 1 << 20
+
+// Statuses of files which content isn't read, or which policies aren't applied.
+const (
+	StatusTooLarge    = "skipped: too large"          // a file is larger than a max blob size
+	StatusBinary      = "skipped: binary"             // a binary file matched a rule that doesn't ask for binaries
+	StatusUnsupported = "skipped: unsupported format" // a file can't be converted to a policy input
 )
 
 // file holds info individual files commit hash and names
@@ -42,20 +48,38 @@ type file struct {
 	URL       string `json:"-"`
 	Config    bool   `json:"-"`
 	Extension string `json:"extension"`
+	Size      int64  `json:"size"`             // bytes
+	Mode      string `json:"mode"`             // git file mode, e.g: 0100644
+	Status    string `json:"status,omitempty"` // why content of a file wasn't read or checked, e.g: StatusTooLarge
+
+	Attributes []string `json:"attributes,omitempty"` // e.g: binary, vendored, see Attributes
+
+	// Rules are names of configs a file matched, in order of configs, Type is the first of them.
+	// Results hold an output of a policy of each rule, rules whose policy had nothing to say are omitted.
+	Rules   []string     `json:"rules,omitempty"`
+	Results []RuleResult `json:"results,omitempty"`
+	Verdict string       `json:"verdict,omitempty"` // the worst verdict of results, e.g: VerdictFail
 
-	OutputPolicy  string `json:"output_policy"`  // output of the opa applied
-	AppliedPolicy string `json:"applied_policy"` // name of the policy
+	Findings []Finding `json:"findings,omitempty"` // findings of policies of all rules, in order of rules
 
-	Content string `json:"content"`
+	Content string `json:"content"` // only filled for files that passed a filter
 
-	Reader io.ReadCloser `json:"-"`
+	open       func() (io.ReadCloser, error) // streams content from a repository
+	detectable bool                          // a file is counted in language stats
+	lines      int64                         // count of lines, only counted for detectable files
 }
 
-type language struct {
-	Count int `json:"count"`
+// RuleResult is an output of a policy a rule applied on a file.
+type RuleResult struct {
+	Rule          string `json:"rule"`                // name of a config
+	Status        string `json:"status,omitempty"`    // why a policy wasn't applied, e.g: StatusBinary
+	AppliedPolicy string `json:"applied_policy"`      // name of the policy
+	Namespace     string `json:"namespace,omitempty"` // package deny, warn and violation rules were evaluated in
 
-	Known   map[string]int `json:"known"`
-	Unknown []string       `json:"unknown"`
+	Policy *PolicyProvenance `json:"policy,omitempty"` // which policy was applied, where it's from and it's version
+
+	Verdict string         `json:"verdict,omitempty"` // pass, warn or fail, empty if a policy wasn't applied
+	Raw     rego.ResultSet `json:"-"`                 // a result set a policy was evaluated to, for debugging policies
 }
 
 // GitCollection is a struct that holds a commit hash and filename in a git repository
@@ -64,67 +88,123 @@ type GitCollection struct {
 	BaseHash string `json:"-"`
 	BaseDir  string `json:"-"`
 
+	Include []string `json:"include,omitempty"` // directories that were scanned, relative to a repository root, all if empty
+	Exclude []string `json:"exclude,omitempty"` // directories that were skipped
+
+	Commit      *commitInfo `json:"commit"`           // resolved revision
+	LastFetched time.Time   `json:"last_fetched"`     // when a repository was cloned or fetched from remote
+	Source      SourceMode  `json:"source,omitempty"` // what files of a local repository were read
+
 	FileCount       int `json:"file_count"`
 	ConfigFileCount int `json:"config_file_count"`
 
 	Language *language `json:"language"`
 
-	Policy *file `json:"-"` // string representation of content of a .rego file
+	// Policy holds modules and data of a policy directory of a repository, it's nil if it doesn't have modules,
+	// policyErr is set instead if they can't be read.
+	Policy    *Policy `json:"-"`
+	policyErr error
+
+	// RepoFilter are filter rules from a config in a root directory of a repository, e.g: .gitfilter.yaml,
+	// RepoFilterError is set instead if it's invalid.
+	RepoFilter      *FilterConfig `json:"repo_filter,omitempty"`
+	RepoFilterName  string        `json:"repo_filter_name,omitempty"`
+	RepoFilterError string        `json:"repo_filter_error,omitempty"`
 
 	Coll []file `json:"file"`
+
+	// Verdict is the worst verdict of filtered files, it's empty if a collection wasn't filtered,
+	// or no policy was applied.
+	Verdict string `json:"verdict,omitempty"`
+
+	release func() // unpins a cached repository that content of files is read from
 }
 
 // Config holds an info about each config file filtering, name: "Docker", filter: "\bDockerfile\b", policy: "https://example.com/1"
 type Config struct {
 	Name      string `json:"name"`
-	Filter    string `json:"filter"`
-	PolicyURL string `json:"policy"`
+	Filter    string `json:"filter,omitempty"` // regexp matched against file names
+	PolicyURL string `json:"policy"`           // a policy source, e.g: a url of a module or a bundle, see ParsePolicySource
+
+	// Glob are gitignore style patterns matched against file names, they are an alternative to Filter,
+	// e.g: ["*.tf", "*.tf.json"]. Exclude are patterns of files a rule skips, e.g: ["examples/**"].
+	Glob    []string `json:"glob,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Attributes files must have to match, ones with a leading ! they must not have, e.g: ["configuration", "!vendored"].
+	// Binary files are only passed to a policy if binary is listed.
+	Attributes []string `json:"attributes,omitempty"`
+
+	// Content matches files by their content, e.g: yaml files that have kind: Deployment.
+	// Match tells how it's combined with Filter, all (default) or any, an empty Filter is ignored in any mode.
+	Content *ContentMatcher `json:"content,omitempty"`
+	Match   string          `json:"match,omitempty"`
+
+	// Type is a name of a built-in file type a rule matches instead of Filter, Glob and Content, e.g: kubernetes.
+	Type string `json:"type,omitempty"`
+
+	// Namespace is a package of a policy deny, warn and violation rules are evaluated in,
+	// FilterOptions.Namespace is used if it's empty.
+	Namespace string `json:"namespace,omitempty"`
 }
 
 // GetGitCollection returns a filled GitCollection struct
 func GetGitCollection(url, hash, dir string) (*GitCollection, error) {
+	return GetGitCollectionContext(context.Background(), url, hash, dir, nil)
+}
+
+// GetGitCollectionContext is the same as GetGitCollection, but it can be canceled by ctx,
+// and reports it's progress to opts.Progress. opts can be nil.
+func GetGitCollectionContext(ctx context.Context, url, hash, dir string, opts *Options) (*GitCollection, error) {
 	var op = "crud.GetGitCollection"
 
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	// initialize vars, so we don't recreate them
 	r := &git.Repository{}
 	coll := &GitCollection{}
 	var err error
 
-	// join and cleanup dir where all repos will be saved
-	path := filepath.Join(reposDir, filepath.Clean(url))
-
-	// clone a repo, cleanups directory name filepath.Clean() implicitly
-	r, err = git.PlainClone(path, false, &git.CloneOptions{
-		URL: url,
-	})
-	if errors.Cause(err) == git.ErrRepositoryAlreadyExists { // check if repo exists, then just open it
-		r, err = git.PlainOpen(path)
-		if err != nil {
-			return nil, errors.Wrapf(err, "(%s): opening a git repo", op)
-		}
-	} else if err != nil {
-		return nil, errors.Wrapf(err, "(%s): cloning a git repo", op)
+	// credentials from url are only used for auth, they never get to the path or a report,
+	// a user gave them for this url, so they take precedence over opts.Auth
+	url, creds := stripCredentials(url)
+	if creds == nil {
+		creds = opts.Auth
+	}
+	auth, err := authMethod(url, creds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): preparing auth", op)
 	}
-	coll.BaseURL = url // for template
 
-	// convert user supplied hash to SHA1 git hash
-	var gitHash plumbing.Hash
-	if hash != "" {
-		gitHash = plumbing.NewHash(hash)
-	} else {
-		ref, err := r.Head()
+	// clone a repo, or open and refresh it if it's cached, a repository cloned with credentials
+	// is only reused by scans with the same credentials
+	opts.Progress.report(StageCloning, 0)
+	cache := opts.Cache
+	if cache == nil {
+		cache = DefaultCache()
+	}
+	r, coll.LastFetched, coll.release, err = openRepository(ctx, url, hash, opts.Clone, opts.Fetch, auth, creds.fingerprint(), cache, opts.Progress)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): opening a git repo", op)
+	}
+	// repository isn't evicted until a collection is closed, since content of files is read lazily
+	defer func() {
 		if err != nil {
-			return nil, errors.Wrapf(err, "(%s): retrieving head commit", op)
+			coll.Close()
 		}
-		gitHash = ref.Hash()
-	}
-	coll.BaseHash = gitHash.String() // for template
+	}()
+	opts.Progress.report(StageCloning, 100)
+	coll.BaseURL = url // for template
 
-	// retrieve a commit
-	commit, err := r.CommitObject(gitHash)
+	// resolve user supplied revision to a commit, HEAD if it's empty
+	commit, info, err := resolveRevision(r, hash, true)
 	if err != nil {
-		return nil, errors.Wrapf(err, "(%s): retrieving a commit object", op)
+		return nil, errors.Wrapf(err, "(%s): resolving a revision", op)
 	}
+	coll.BaseHash = info.Hash // for template
+	coll.Commit = info
 
 	// retreive a file structure of specific commit
 	tree, err := commit.Tree()
@@ -132,327 +212,443 @@ func GetGitCollection(url, hash, dir string) (*GitCollection, error) {
 		return nil, errors.Wrapf(err, "(%s): retrieving a commit file structure", op)
 	}
 
-	var name, content string
-	// retrieve files from specific dir
+	include := opts.Include
 	if dir != "" {
-		coll.Coll, coll.FileCount, coll.Language, err = retrieveFromDir(url, coll.BaseHash, dir, tree)
-		if err != nil {
-			return nil, errors.Wrapf(err, "(%s): retrieving list of files", op)
-		}
-
-		// search for a policy file
-		name, content, err = findPolicyFromDir(dir, tree)
-		if err != nil {
-			return nil, errors.Wrapf(err, "(%s): searching a .rego file", op)
-		}
-
-		coll.BaseDir = dir
-	} else { // retrieve files from root dir
-		coll.Coll, coll.FileCount, coll.Language, err = retrieveFromRoot(url, coll.BaseHash, tree)
-		if err != nil {
-			return nil, errors.Wrapf(err, "(%s): retrieving list of files", op)
-		}
+		include = append([]string{dir}, include...)
+	}
+	include, err = cleanDirs(include)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): parsing included directories", op)
+	}
+	exclude, err := cleanDirs(opts.Exclude)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): parsing excluded directories", op)
+	}
 
-		// search for a policy file
-		name, content, err = findPolicyFromRoot(tree)
-		if err != nil {
-			return nil, errors.Wrapf(err, "(%s): searching a .rego file", op)
-		}
+	files, err := subtreeFiles(ctx, newBlobReaders(r), tree, include, opts.policyDir())
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): retrieving list of files", op)
+	}
 
-		coll.BaseDir = "/"
+	blobURL := func(name string) string {
+		return url + "/blob/" + coll.BaseHash + "/" + name
 	}
-	if name != "" && content != "" { // for applying policy
-		coll.Policy = &file{}
-		coll.Policy.Content = content
-		coll.Policy.Name = name
+	if err = coll.index(ctx, files, include, exclude, blobURL, opts); err != nil {
+		return nil, errors.Wrapf(err, "(%s): retrieving list of files", op)
 	}
 
 	// retrieve files from root
 	return coll, nil
 }
 
-// retrieveFromDir returns a collection that has all files from a repo in a specific dir.
-// It returns the collection of files in a git specific dir, the count of files, the slice of programming languages, and slice of unknown pr langs,
-// also it returns the map of language and count of files that language use.
-func retrieveFromDir(url, hash, dir string, tree *object.Tree) ([]file, int, *language, error) {
-	var coll []file
-	var err error
-	var count int
-	var langs = &language{
-		Known: make(map[string]int),
+// Close releases a cached repository of a collection, so it can be evicted.
+// Content of files that weren't filtered yet can't be read after it.
+func (c *GitCollection) Close() {
+	if c.release != nil {
+		c.release()
 	}
+}
 
-	err = tree.Files().ForEach(func(f *object.File) error {
-		if strings.Contains(f.Name, dir) {
-			co := file{}
-
-			co.Hash = f.Hash.String()
-
-			co.Name = f.Name[strings.Index(f.Name, "/")+1:]
-			co.URL = url + "/blob/" + hash + "/" + dir + "/" + co.Name
-
-			co.Reader, err = f.Reader()
-			if err != nil {
-				return err
-			}
+// index fills coll with files that are inside include directories and aren't inside exclude ones,
+// and searches for a policy file among them. blobURL returns a link to a file with a given name.
+// Only metadata of files is kept, their content is read when they pass a filter.
+func (coll *GitCollection) index(ctx context.Context, files []sourceFile, include, exclude []string, blobURL func(name string) string, opts *Options) error {
+	opts.Progress.report(StageIndexing, 0)
 
-			co.Content, err = f.Contents()
-			if err != nil {
-				return err
-			}
+	// .gitattributes files outside of included directories apply to files inside them too
+	attrs, err := readGitAttributes(files)
+	if err != nil {
+		return err
+	}
 
-			co.Extension, _ = enry.GetLanguageByExtension(f.Name)
-			if co.Extension == "" { // if can't determine ext by name then lookup it's content
-				co.Extension, _ = enry.GetLanguageByContent(f.Name, []byte(co.Content))
-				if co.Extension == "" {
-					co.Extension = "Unknown"
-				}
-			}
+	// a filter config and a policy of a repository are read even if their directories aren't scanned
+	if err = coll.readRepoConfig(files); err != nil {
+		return err
+	}
+	coll.Policy, coll.policyErr = readRepoPolicy(policyFiles(files, include, opts.policyDir()), opts.policyDir())
 
-			// add the count of each language file used
-			if co.Extension == "Unknown" {
-				langs.Unknown = append(langs.Unknown, f.Name)
-			} else {
-				langs.Count++
-			}
-			langs.Known[co.Extension]++
+	files, err = scopeFiles(files, include, exclude)
+	if err != nil {
+		return err
+	}
 
-			coll = append(coll, co)
-			count++
-		}
+	maxSize := opts.MaxBlobSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxBlobSize
+	}
 
-		return nil
-	})
+	coll.Coll, coll.FileCount, coll.Language, err = retrieveFiles(ctx, files, blobURL, maxSize, attrs, opts.workers(), opts.Progress)
 	if err != nil {
-		return nil, 0, nil, err
+		return err
+	}
+
+	coll.Include = include
+	coll.Exclude = exclude
+	coll.BaseDir = "/"
+	if len(include) > 0 {
+		coll.BaseDir = strings.Join(include, ", ")
 	}
+	opts.Progress.report(StageIndexing, 100)
 
-	return coll, count, langs, nil
+	return nil
 }
 
-// retrieveFromRoot returns a collection that has all files from a repo in a root dir.
-// It returns the collection of files in a git root dir, the count of files, the slice of programming languages, and slice of unknown pr langs,
-// also it returns the map of language and count of files that language use.
-func retrieveFromRoot(url, hash string, tree *object.Tree) ([]file, int, *language, error) {
-	var coll []file
-	var err error
-	var count int
-	var langs = &language{
-		Known: make(map[string]int),
+// policyFiles returns files a policy of a repository is read from, a policy of a whole repository is only read
+// from include directories, like subtreeFiles lists them, files of other policy directories are all returned.
+func policyFiles(files []sourceFile, include []string, policyDir string) []sourceFile {
+	if policyDir != "" || len(include) == 0 {
+		return files
 	}
 
-	err = tree.Files().ForEach(func(f *object.File) error {
-		co := file{}
+	var scoped []sourceFile
+	for _, f := range files {
+		if inDirs(f.Name, include) {
+			scoped = append(scoped, f)
+		}
+	}
 
-		co.Hash = f.Hash.String()
+	return scoped
+}
 
-		co.Name = f.Name
-		co.URL = url + "/blob/" + hash + "/" + f.Name
+// newFile makes a file of a source file, and detects it's attributes and language by it's name and the beginning
+// of it's content, linguist attributes of .gitattributes override them. Lines are counted for files that are
+// counted in language stats. Content isn't read if a file is larger than maxSize, negative maxSize means no limit.
+func newFile(f sourceFile, url string, maxSize int64, attrs gitAttributes) (file, error) {
+	co := file{}
 
-		co.Reader, err = f.Reader()
-		if err != nil {
-			return err
+	var err error
+	if f.Hash.IsZero() { // a file on disk isn't in git yet
+		if f.Hash, err = f.hash(); err != nil {
+			return co, err
 		}
+	}
 
-		co.Content, err = f.Contents()
-		if err != nil {
-			return err
-		}
+	co.Hash = f.Hash.String()
+	co.Name = f.Name
+	co.URL = url
+	co.Size = f.Size
+	co.Mode = f.Mode.String()
+	co.open = f.open
+	if maxSize >= 0 && f.Size > maxSize {
+		co.Status = StatusTooLarge
+	}
 
-		co.Extension, _ = enry.GetLanguageByExtension(f.Name)
-		if co.Extension == "" { // if can't determine ext by name then lookup it's content
-			co.Extension, _ = enry.GetLanguageByContent(f.Name, []byte(co.Content))
-			if co.Extension == "" {
-				co.Extension = "Unknown"
-			}
+	var head []byte
+	if co.Status == "" {
+		if head, err = f.sniff(); err != nil {
+			return co, err
 		}
+	}
+	co.Attributes = classify(f.Name, head)
 
-		// add the count of each language file used
-		if co.Extension == "Unknown" {
-			langs.Unknown = append(langs.Unknown, f.Name)
-		} else {
-			langs.Count++
-		}
-		langs.Known[co.Extension]++
+	// a language is detected by name, and when it's ambiguous, e.g: .yaml or .md, by content
+	co.Extension = enry.GetLanguage(f.Name, head)
+	if co.Extension == "" {
+		co.Extension = "Unknown"
+	}
 
-		coll = append(coll, co)
-		count++
+	co.applyLinguist(attrs.match(f.Name))
 
-		return nil
-	})
-	if err != nil {
-		return nil, 0, nil, err
+	excluded := co.Is(AttrBinary) || co.Is(AttrVendored) || co.Is(AttrGenerated) || co.Is(AttrDocumentation)
+	if co.detectable && !excluded && co.Status == "" {
+		if co.lines, err = countLines(f, head); err != nil {
+			return co, err
+		}
 	}
 
-	return coll, count, langs, nil
+	return co, nil
 }
 
-// findPolicy searches for a policy .rego file in a git repository specific dir,
-// if it finds a file, it returns a file's content converted to string,
-// else nil.
-func findPolicyFromDir(dir string, tree *object.Tree) (name, content string, err error) {
-	tree.Files().ForEach(func(f *object.File) error {
-		if strings.Contains(f.Name, dir) {
-			if strings.Contains(f.Name, ".rego") {
-				content, err = f.Contents()
-
-				name = f.Name
+// read returns content of a file, it fails if content wasn't read because of it's status.
+func (f *file) read() ([]byte, error) {
+	if f.Status != "" {
+		return nil, errors.Errorf("%s: %s", f.Name, f.Status)
+	}
 
-				return nil
-			}
-		}
-		return nil
-	})
+	rc, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
 
-	return
+	return ioutil.ReadAll(rc)
 }
 
-// findPolicy searches for a policy .rego file in a git repository,
-// if it finds a file, it returns a file's content converted to string,
-// else nil.
-func findPolicyFromRoot(tree *object.Tree) (name, content string, err error) {
-	tree.Files().ForEach(func(f *object.File) error {
-		if strings.Contains(f.Name, ".rego") {
-			content, err = f.Contents()
+// retrieveFiles returns a collection that has all files, the count of files, and languages they use.
+// Files are read and classified by workers goroutines, but they are returned in the same order as files.
+func retrieveFiles(ctx context.Context, files []sourceFile, blobURL func(string) string, maxSize int64, attrs gitAttributes, workers int, progress ProgressFunc) ([]file, int, *language, error) {
+	coll := make([]file, len(files))
 
-			name = f.Name
-
-			return nil
+	var mu sync.Mutex // keeps reported progress from going back
+	var done int
+	err := parallel(ctx, len(files), workers, func(ctx context.Context, i int) error {
+		co, err := newFile(files[i], blobURL(files[i].Name), maxSize, attrs)
+		if err != nil {
+			return err
 		}
+		coll[i] = co
+
+		mu.Lock()
+		done++
+		progress.report(StageIndexing, done*100/len(files))
+		mu.Unlock()
+
 		return nil
 	})
+	if err != nil {
+		return nil, 0, nil, err
+	}
 
-	return
+	// languages are counted in order, so stats don't depend on the order workers finish
+	var langs = newLanguage()
+	for _, co := range coll {
+		langs.add(co)
+	}
+	langs.finish()
+
+	return coll, len(coll), langs, nil
 }
 
 // Filter applies regexp on content of each config file that is specified, and returns new collection with filtered result.
 func (c *GitCollection) Filter(confs []Config) (*GitCollection, error) {
+	return c.FilterContext(context.Background(), confs, nil)
+}
+
+// match is a file that matched configs, and is waiting for their policies to be applied.
+type match struct {
+	coll    file
+	confs   []Config     // in order of configs
+	content *fileContent // shared by all rules of a file, so it's read once
+}
+
+// FilterContext is the same as Filter, but it can be canceled by ctx,
+// and reports it's progress to opts.Progress. opts can be nil.
+func (c *GitCollection) FilterContext(ctx context.Context, confs []Config, opts *FilterOptions) (*GitCollection, error) {
 	op := "crud.GitCollectionFilter"
 
+	if opts == nil {
+		opts = &FilterOptions{}
+	}
+
 	newColl := &GitCollection{
 		BaseURL:  c.BaseURL,
 		BaseHash: c.BaseHash,
 		BaseDir:  c.BaseDir,
-	}
+		Include:  c.Include,
+		Exclude:  c.Exclude,
+		Commit:   c.Commit,
+		Source:   c.Source,
 
-	var err error
-	reg := &regexp.Regexp{}
-	for _, coll := range c.Coll {
-		for _, conf := range confs {
-			// 1: Filter by regex
-			reg, err = regexp.Compile(conf.Filter)
-			if err != nil {
-				return nil, errors.Wrapf(err, "(%s): invalid %s regexp", op, conf.Name)
-			}
+		LastFetched: c.LastFetched,
+	}
 
-			if !reg.MatchString(coll.Name) {
-				continue
-			}
-			coll.Type = conf.Name // make the type same as a name of regex
+	var exclude gitignore.Matcher
+	if len(opts.Exclude) > 0 {
+		var err error
+		if exclude, err = newGlobs(opts.Exclude); err != nil {
+			return nil, errors.Wrapf(err, "(%s): invalid exclude", op)
+		}
+	}
 
-			// 2: Filter by policy
-			var policy string
-			var err error
+	if err := validateNamespace(opts.Namespace); err != nil {
+		return nil, errors.Wrapf(err, "(%s)", op)
+	}
 
-			if conf.PolicyURL != "" { // get a policy from url
-				policy, err = getPolicyFromURL(conf.PolicyURL)
-				if err != nil {
-					return nil, errors.Wrapf(err, "(%s): retrieving policy file from %s", op, conf.PolicyURL)
-				}
+	// compile all rules once
+	rules := make([]*rule, len(confs))
+	for i, conf := range confs {
+		r, err := newRule(conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): invalid %s rule", op, conf.Name)
+		}
+		rules[i] = r
+	}
 
-				coll.AppliedPolicy = conf.PolicyURL
-			} else if c.Policy != nil { // use a policy from git repo
-				policy = c.Policy.Content
+	// 1: Filter by name, attributes and content
+	var matches []match
+	opts.Progress.report(StageFiltering, 0)
+	for i, coll := range c.Coll {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrapf(err, "(%s): filtering files", op)
+		}
 
-				coll.AppliedPolicy = c.Policy.Name
-			} else { // use default policy
-				temp, err := ioutil.ReadFile(defaultPolicy)
-				if err != nil {
-					return nil, errors.Wrapf(err, "(%s): reading default policy file", op)
-				}
+		if exclude != nil && matchGlobs(exclude, coll.Name) {
+			opts.Progress.report(StageFiltering, (i+1)*100/len(c.Coll))
+			continue
+		}
 
-				policy = string(temp)
+		m := match{coll: coll, content: &fileContent{f: coll}}
+		for _, r := range rules {
+			ok, err := r.match(coll, m.content)
+			if err != nil {
+				return nil, errors.Wrapf(err, "(%s): matching %s file", op, coll.Name)
+			}
+			if !ok {
+				continue
+			}
 
-				coll.AppliedPolicy = "not found"
+			m.confs = append(m.confs, r.conf)
+			m.coll.Rules = append(m.coll.Rules, r.conf.Name)
+			if opts.FirstMatch {
+				break
 			}
+		}
+		if len(m.confs) > 0 {
+			m.coll.Type = m.confs[0].Name // make the type same as a name of the first regex
+			matches = append(matches, m)
+		}
+		opts.Progress.report(StageFiltering, (i+1)*100/len(c.Coll))
+	}
+	opts.Progress.report(StageFiltering, 100)
 
-			input, err := util.ToJSON(coll.Name, coll.Reader) // convert a config file to json, and then pass it to OPA.s
-			if errors.Cause(err) == util.ErrUnsupportedFileType {
-				continue
-			} else if err != nil || len(input) == 0 || input == nil {
-				return nil, errors.Wrapf(err, "(%s): converting %s file to json", op, coll.Name)
+	// 2: Filter by policy
+	policies := newPolicyResolver(c, opts.Policies)
+	opts.Progress.report(StageEvaluating, 0)
+	for i, m := range matches {
+		coll, err := c.applyPolicies(ctx, m, opts.namespace(), policies)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): applying policies to %s file", op, m.coll.Name)
+		}
+
+		if len(coll.Results) > 0 {
+			if coll.Status == "" {
+				newColl.ConfigFileCount++ // count the number of filtered files
 			}
-			newColl.ConfigFileCount++ // count the number of filtered files
+			newColl.Verdict = worseVerdict(newColl.Verdict, coll.Verdict)
+			newColl.Coll = append(newColl.Coll, coll)
+		}
+		opts.Progress.report(StageEvaluating, (i+1)*100/len(matches))
+	}
+	opts.Progress.report(StageEvaluating, 100)
 
-			// create a new rego object
-			r := rego.New(
-				rego.Query("data"),
-				rego.Module(conf.PolicyURL, policy),
-				rego.Input(input),
-			)
+	return newColl, nil
+}
 
-			ctx := context.Background()
+// applyPolicies applies a policy of each config a file matched, and returns the file with their results.
+// Content of a file is only read now, files that are too large, binary or of a format policies can't take
+// are reported without a policy, if no policy was applied to a file, it's Status tells why. Policies of configs without a namespace are evaluated in ns.
+func (c *GitCollection) applyPolicies(ctx context.Context, m match, ns string, policies *policyResolver) (file, error) {
+	coll := m.coll
+
+	var (
+		input       interface{} // decoded once, a policy gets a document, not it's json
+		converted   bool
+		unsupported bool // a file isn't passed to policies, but it's kept, so it's clear it wasn't checked
+		evaluated   bool
+	)
+	for _, conf := range m.confs {
+		res := RuleResult{Rule: conf.Name, Status: coll.Status}
+		if res.Status == "" && coll.Is(AttrBinary) && !conf.allowsBinary() {
+			res.Status = StatusBinary
+		}
+		if res.Status != "" {
+			coll.Results = append(coll.Results, res)
+			continue
+		}
 
-			// evaluate a policy and query on config file
-			rs, err := r.Eval(ctx)
+		if !converted {
+			content, err := m.content.bytes()
 			if err != nil {
-				return nil, errors.Wrapf(err, "(%s): evaluating a query of a %s", op, coll.Name)
+				return coll, errors.Wrap(err, "reading a file")
 			}
 
-			// display all variables from rego file if result set isn't 0
-			if len(rs) != 0 {
-				for _, busu := range rs {
-					for _, miki := range busu.Expressions {
-						mapi := miki.Value.(map[string]interface{})
-						for _, pur := range mapi {
-							mupi := pur.(map[string]interface{})
-							for ind, shind := range mupi {
-								coll.OutputPolicy = fmt.Sprintf("%s: %v", ind, shind)
-							}
-						}
-					}
-				}
-
-				newColl.Coll = append(newColl.Coll, coll)
+			js, err := util.ToJSON(coll.Name, ioutil.NopCloser(bytes.NewReader(content))) // convert a config file to json, and then pass it to OPA.s
+			if errors.Cause(err) == util.ErrUnsupportedFileType {
+				unsupported = true
+			} else if err != nil || len(js) == 0 {
+				return coll, errors.Wrap(err, "converting a file to json")
+			} else if err = json.Unmarshal(js, &input); err != nil {
+				return coll, errors.Wrap(err, "decoding json of a file")
+			} else {
+				coll.Content = string(content)
 			}
+			converted = true
+		}
+		if unsupported {
+			res.Status = StatusUnsupported
+			coll.Results = append(coll.Results, res)
+			continue
 		}
+
+		res.Namespace = ns
+		if conf.Namespace != "" {
+			res.Namespace = conf.Namespace
+		}
+		findings, err := applyPolicy(ctx, policies, conf, input, &res)
+		if err != nil {
+			return coll, err
+		}
+		coll.Results = append(coll.Results, res)
+		coll.Findings = append(coll.Findings, findings...)
+		coll.Verdict = worseVerdict(coll.Verdict, res.Verdict)
+		evaluated = true
 	}
 
-	return newColl, nil
+	if !evaluated {
+		coll.Content = ""
+		if coll.Status == "" && len(coll.Results) > 0 {
+			coll.Status = coll.Results[0].Status // all rules skipped a file, e.g: a binary one
+		}
+	}
+
+	return coll, nil
 }
 
-// getPolicyFromURL retrieves a policy from url
-// and returns it's content in string format.
-func getPolicyFromURL(url string) (content string, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+// applyPolicy evaluates deny, violation and warn rules of a policy of a config in res.Namespace on input,
+// saves a verdict, a result set and where a policy is from in res, and returns findings of the rules.
+func applyPolicy(ctx context.Context, policies *policyResolver, conf Config, input interface{}, res *RuleResult) ([]Finding, error) {
+	// a policy of a rule, of a repository, of an organization or a default one
+	policy, step, err := policies.resolve(ctx, conf)
 	if err != nil {
-		return "", err
+		return nil, errors.Wrapf(err, "resolving a policy of %s rule", conf.Name)
 	}
+	res.AppliedPolicy = policy.Name
+	res.Policy = policy.provenance(step)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// query a whole package, so all rules are evaluated at once, modules of a policy are compiled together
+	rs, err := policies.eval(ctx, policy, "data."+res.Namespace, input)
 	if err != nil {
-		return "", err
+		return nil, errors.Wrapf(err, "evaluating a query of %s rule", conf.Name)
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		// like conftest, a policy without the package has nothing to say about a file
+		res.Verdict = VerdictPass
+		res.Raw = rs
+		return nil, nil
 	}
-	defer resp.Body.Close()
 
-	buf := &strings.Builder{}
-	b, err := io.Copy(buf, resp.Body)
+	doc, ok := rs[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("%s of policy %s isn't a package", res.Namespace, res.AppliedPolicy)
+	}
+	findings, err := policyFindings(conf.Name, doc)
 	if err != nil {
-		return "", err
-	} else if b == 0 {
-		return "", errors.New("no bytes copied from response")
+		return nil, errors.Wrapf(err, "reading findings of policy %s", res.AppliedPolicy)
+	}
+	res.Verdict = findingsVerdict(findings)
+	res.Raw = rs
+
+	return findings, nil
+}
+
+// allowsBinary returns true if binary files that match a config are passed to a policy.
+func (conf Config) allowsBinary() bool {
+	for _, a := range conf.Attributes {
+		if a == AttrBinary {
+			return true
+		}
 	}
 
-	return buf.String(), nil
+	return false
 }
 
-// ToJSONFile returns a json representation of a Git collection in a file.
+// ToJSONFile returns a json representation of a Git collection in a file in a temporary directory,
+// a caller closes and removes it.
 func (c *GitCollection) ToJSONFile() (*os.File, error) {
 	op := "crud.GitCollectionToJSON"
 
 	// create a json file for serving
-	f, err := os.Create(util.RandomString(10) + ".json")
+	f, err := ioutil.TempFile("", util.RandomString(10)+"-*.json")
 	if err != nil {
 		return nil, errors.Wrapf(err, "(%s): creating new json file", op)
 	}
@@ -460,6 +656,8 @@ func (c *GitCollection) ToJSONFile() (*os.File, error) {
 	// create a new json file with config files
 	err = json.NewEncoder(f).Encode(c)
 	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return nil, errors.Wrapf(err, "(%s): encoding file to json", op)
 	}
 
@@ -0,0 +1,287 @@
+package crud
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+
+	enry "github.com/go-enry/go-enry/v2"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitattributes"
+)
+
+// gitattributesFile is a file that holds attributes of files in each directory of a repository.
+const gitattributesFile = ".gitattributes"
+
+// linguist attributes of .gitattributes that override how a file is classified, like GitHub linguist does.
+const (
+	linguistVendored      = "linguist-vendored"
+	linguistGenerated     = "linguist-generated"
+	linguistDocumentation = "linguist-documentation"
+	linguistDetectable    = "linguist-detectable"
+	linguistLanguage      = "linguist-language"
+)
+
+// language holds statistics of languages files use, vendored, generated, documentation and binary files
+// aren't counted, as well as files which language can't be detected.
+type language struct {
+	Count int `json:"count"` // count of files which language is known
+
+	Known   map[string]int `json:"known"`   // count of files of each language
+	Unknown []string       `json:"unknown"` // names of files which language isn't known
+
+	Bytes int64          `json:"bytes"` // total size of files in Stats
+	Lines int64          `json:"lines"`
+	Stats []languageStat `json:"stats"` // breakdown of programming and markup languages, largest first
+}
+
+// languageStat is a share of a single language in a repository, like in a language bar of GitHub.
+type languageStat struct {
+	Name    string  `json:"name"`
+	Color   string  `json:"color"` // html color of a language, e.g: #00ADD8
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+	Lines   int64   `json:"lines"`   // lines of files that are larger than a max blob size aren't counted
+	Percent float64 `json:"percent"` // percent of bytes, rounded to 0.1
+}
+
+// newLanguage is a constructor for language.
+func newLanguage() *language {
+	return &language{
+		Known: make(map[string]int),
+	}
+}
+
+// add counts a file in language statistics, if it's not excluded.
+func (l *language) add(f file) {
+	if f.Is(AttrBinary) || f.Is(AttrVendored) || f.Is(AttrGenerated) || f.Is(AttrDocumentation) {
+		return
+	}
+
+	if f.Extension == "Unknown" {
+		l.Unknown = append(l.Unknown, f.Name)
+		return
+	}
+	l.Count++
+	l.Known[f.Extension]++
+
+	if !f.detectable {
+		return
+	}
+
+	var stat *languageStat
+	for i := range l.Stats {
+		if l.Stats[i].Name == f.Extension {
+			stat = &l.Stats[i]
+		}
+	}
+	if stat == nil {
+		l.Stats = append(l.Stats, languageStat{Name: f.Extension, Color: enry.GetColor(f.Extension)})
+		stat = &l.Stats[len(l.Stats)-1]
+	}
+
+	stat.Files++
+	stat.Bytes += f.Size
+	stat.Lines += f.lines
+	l.Bytes += f.Size
+	l.Lines += f.lines
+}
+
+// finish computes percents of languages and sorts them, it's called when all files were added.
+func (l *language) finish() {
+	for i := range l.Stats {
+		if l.Bytes > 0 {
+			l.Stats[i].Percent = math.Round(float64(l.Stats[i].Bytes)*1000/float64(l.Bytes)) / 10
+		}
+	}
+
+	sort.SliceStable(l.Stats, func(i, j int) bool {
+		if l.Stats[i].Bytes != l.Stats[j].Bytes {
+			return l.Stats[i].Bytes > l.Stats[j].Bytes
+		}
+		return l.Stats[i].Name < l.Stats[j].Name
+	})
+}
+
+// isDetectable returns true if a language is counted in language stats by default,
+// linguist only counts programming and markup languages.
+func isDetectable(lang string) bool {
+	t := enry.GetLanguageType(lang)
+	return t == enry.Programming || t == enry.Markup
+}
+
+// countLines returns a count of lines of a source file, head is it's beginning that was already read.
+func countLines(f sourceFile, head []byte) (int64, error) {
+	if int64(len(head)) >= f.Size {
+		return lines(head), nil
+	}
+
+	rc, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	var n int64
+	var last byte
+	buf := make([]byte, 32*1024)
+	for {
+		c, err := rc.Read(buf)
+		if c > 0 {
+			n += int64(bytes.Count(buf[:c], []byte{'\n'}))
+			last = buf[c-1]
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if f.Size > 0 && last != '\n' { // the last line doesn't end with a new line
+		n++
+	}
+
+	return n, nil
+}
+
+// lines returns a count of lines in b.
+func lines(b []byte) int64 {
+	n := int64(bytes.Count(b, []byte{'\n'}))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+
+	return n
+}
+
+// gitAttributes holds .gitattributes patterns of a repository, in order of increasing priority.
+type gitAttributes []gitattributes.MatchAttribute
+
+// readGitAttributes reads all .gitattributes files among files, a file in a deeper directory
+// takes precedence over ones in it's parents.
+func readGitAttributes(files []sourceFile) (gitAttributes, error) {
+	var attrFiles []sourceFile
+	for _, f := range files {
+		if path.Base(f.Name) == gitattributesFile {
+			attrFiles = append(attrFiles, f)
+		}
+	}
+	sort.SliceStable(attrFiles, func(i, j int) bool {
+		return strings.Count(attrFiles[i].Name, "/") < strings.Count(attrFiles[j].Name, "/")
+	})
+
+	var attrs gitAttributes
+	for _, f := range attrFiles {
+		var domain []string
+		if dir := path.Dir(f.Name); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+
+		rc, err := f.open()
+		if err != nil {
+			return nil, err
+		}
+		ma, err := gitattributes.ReadAttributes(rc, domain, len(domain) == 0)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, ma...)
+	}
+
+	return attrs, nil
+}
+
+// match returns attributes of a file with name, the last matching pattern of an attribute wins.
+func (ga gitAttributes) match(name string) map[string]gitattributes.Attribute {
+	results := make(map[string]gitattributes.Attribute)
+	p := strings.Split(name, "/")
+	for _, ma := range ga {
+		if ma.Pattern == nil || !ma.Pattern.Match(p) {
+			continue
+		}
+		for _, a := range ma.Attributes {
+			results[a.Name()] = a
+		}
+	}
+
+	return results
+}
+
+// linguistFlag returns a value of a boolean linguist attribute, ok is false if it isn't specified.
+func linguistFlag(attrs map[string]gitattributes.Attribute, name string) (value, ok bool) {
+	a, found := attrs[name]
+	switch {
+	case !found || a.IsUnspecified():
+		return false, false
+	case a.IsSet():
+		return true, true
+	case a.IsUnset():
+		return false, true
+	}
+
+	switch strings.ToLower(a.Value()) {
+	case "true", "1":
+		return true, true
+	case "false", "0":
+		return false, true
+	}
+
+	return false, false
+}
+
+// applyLinguist overrides attributes and a language of a file with linguist attributes of .gitattributes.
+func (f *file) applyLinguist(attrs map[string]gitattributes.Attribute) {
+	for attr, name := range map[string]string{
+		AttrVendored:      linguistVendored,
+		AttrGenerated:     linguistGenerated,
+		AttrDocumentation: linguistDocumentation,
+	} {
+		value, ok := linguistFlag(attrs, name)
+		if !ok {
+			continue
+		}
+		if value && !f.Is(attr) {
+			f.Attributes = append(f.Attributes, attr)
+		} else if !value {
+			f.Attributes = removeAttribute(f.Attributes, attr)
+		}
+	}
+	sortAttributes(f.Attributes)
+
+	if a, ok := attrs[linguistLanguage]; ok && a.IsValueSet() {
+		if lang, ok := enry.GetLanguageByAlias(a.Value()); ok {
+			f.Extension = lang
+		}
+	}
+
+	f.detectable = isDetectable(f.Extension)
+	if value, ok := linguistFlag(attrs, linguistDetectable); ok {
+		f.detectable = value
+	}
+}
+
+// removeAttribute returns attrs without attr.
+func removeAttribute(attrs []string, attr string) []string {
+	var kept []string
+	for _, a := range attrs {
+		if a != attr {
+			kept = append(kept, a)
+		}
+	}
+
+	return kept
+}
+
+// sortAttributes sorts attrs in order of Attributes.
+func sortAttributes(attrs []string) {
+	order := make(map[string]int, len(Attributes))
+	for i, a := range Attributes {
+		order[a] = i
+	}
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return order[attrs[i]] < order[attrs[j]]
+	})
+}
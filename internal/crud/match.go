@@ -0,0 +1,372 @@
+package crud
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+)
+
+// Match modes of Config, they tell how a filename rule and content matchers are combined.
+const (
+	MatchAll = "all" // a file must match a filename rule and content matchers, default
+	MatchAny = "any" // a file must match a filename rule or content matchers
+)
+
+// ContentMatcher matches files by their content, a file must match all of the fields that are set.
+// Content of files that are too large, and of binary files unless a rule asks for them, is never matched.
+type ContentMatcher struct {
+	Regexp string `json:"regexp,omitempty"` // matched against a whole content, e.g: "kind:\\s*Deployment"
+
+	// Keys are keys a json or yaml document must have, nested keys are separated by dots, e.g: metadata.name.
+	// In a yaml file with several documents, one of them must have all the keys.
+	Keys []string `json:"keys,omitempty"`
+
+	// Values are keys a json or yaml document must have with given values, e.g: {"kind": "Deployment"}.
+	Values map[string]string `json:"values,omitempty"`
+
+	// Shebang is matched against the first line without #!, e.g: "python3?$", a file without a shebang doesn't match.
+	Shebang string `json:"shebang,omitempty"`
+}
+
+// empty returns true if no fields of a matcher are set.
+func (m *ContentMatcher) empty() bool {
+	return m == nil || m.Regexp == "" && len(m.Keys) == 0 && len(m.Values) == 0 && m.Shebang == ""
+}
+
+// rule is a compiled Config.
+type rule struct {
+	conf Config
+
+	name    *regexp.Regexp    // nil if a rule doesn't have a filename filter
+	glob    gitignore.Matcher // nil if a rule doesn't have glob patterns
+	exclude gitignore.Matcher
+	content *regexp.Regexp
+	shebang *regexp.Regexp
+}
+
+// fieldError is an error of a field of a rule, e.g: content.regexp, so it's reported at a position of the field.
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.err.Error()
+}
+
+// fieldErrorf returns an error of a field wrapped with msg, fields of a nested fieldError are appended
+// to field, e.g: glob and 1 are glob.1.
+func fieldErrorf(field string, err error, msg string) error {
+	if fe, ok := err.(*fieldError); ok {
+		field, err = joinField(field, fe.field), fe.err
+	}
+	if msg != "" {
+		err = errors.Wrap(err, msg)
+	}
+
+	return &fieldError{field: field, err: err}
+}
+
+// newRule compiles regexps of a config and checks it's fields, an invalid field is reported as a fieldError.
+func newRule(conf Config) (*rule, error) {
+	// exclude patterns of a type are added to ones of a rule, so the rule's own are checked before
+	if _, err := newGlobs(conf.Exclude); err != nil {
+		return nil, fieldErrorf("exclude", err, "invalid exclude")
+	}
+
+	conf, err := conf.withType()
+	if err != nil {
+		return nil, fieldErrorf("type", err, "")
+	}
+	r := &rule{conf: conf}
+
+	switch conf.Match {
+	case "", MatchAll, MatchAny:
+	default:
+		return nil, fieldErrorf("match", errors.Errorf("unknown match %q, must be %s or %s", conf.Match, MatchAll, MatchAny), "")
+	}
+	if err := validateNamespace(conf.Namespace); err != nil {
+		return nil, fieldErrorf("namespace", err, "")
+	}
+
+	if conf.Filter != "" && len(conf.Glob) > 0 {
+		return nil, fieldErrorf("glob", errors.New("filter and glob can't be both set"), "")
+	}
+
+	if len(conf.Glob) > 0 {
+		if r.glob, err = newGlobs(conf.Glob); err != nil {
+			return nil, fieldErrorf("glob", err, "invalid glob")
+		}
+	} else if conf.Filter != "" || conf.Content.empty() {
+		if r.name, err = regexp.Compile(conf.Filter); err != nil {
+			return nil, fieldErrorf("filter", err, "invalid filter regexp")
+		}
+	}
+
+	if len(conf.Exclude) > 0 {
+		if r.exclude, err = newGlobs(conf.Exclude); err != nil {
+			return nil, fieldErrorf("exclude", err, "invalid exclude")
+		}
+	}
+
+	if err = ValidateAttributes(conf.Attributes); err != nil {
+		return nil, fieldErrorf("attributes", err, "")
+	}
+
+	if conf.Content.empty() {
+		return r, nil
+	}
+	if conf.Content.Regexp != "" {
+		if r.content, err = regexp.Compile(conf.Content.Regexp); err != nil {
+			return nil, fieldErrorf("content.regexp", err, "invalid content regexp")
+		}
+	}
+	if conf.Content.Shebang != "" {
+		if r.shebang, err = regexp.Compile(conf.Content.Shebang); err != nil {
+			return nil, fieldErrorf("content.shebang", err, "invalid shebang regexp")
+		}
+	}
+
+	return r, nil
+}
+
+// match returns true if a file matches a rule, it's content is only loaded if a filename rule
+// doesn't decide a result alone.
+func (r *rule) match(f file, c *fileContent) (bool, error) {
+	if !f.hasAttributes(r.conf.Attributes) || r.exclude != nil && matchGlobs(r.exclude, f.Name) {
+		return false, nil
+	}
+
+	if r.conf.Content.empty() {
+		return r.matchName(f.Name), nil
+	}
+
+	any := r.conf.Match == MatchAny
+	if r.name != nil || r.glob != nil {
+		if ok := r.matchName(f.Name); ok && any {
+			return true, nil
+		} else if !ok && !any {
+			return false, nil
+		}
+	}
+
+	// binary files are only matched by content if a rule asks for them
+	if f.Status != "" || f.Is(AttrBinary) && !r.conf.allowsBinary() {
+		return false, nil
+	}
+
+	b, err := c.bytes()
+	if err != nil {
+		return false, err
+	}
+
+	if r.content != nil && !r.content.Match(b) {
+		return false, nil
+	}
+
+	if r.shebang != nil {
+		line := b
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		if !bytes.HasPrefix(line, []byte("#!")) || !r.shebang.Match(bytes.TrimSpace(line[2:])) {
+			return false, nil
+		}
+	}
+
+	if len(r.conf.Content.Keys) > 0 || len(r.conf.Content.Values) > 0 {
+		for _, doc := range c.documents() {
+			if hasKeys(doc, r.conf.Content.Keys, r.conf.Content.Values) {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// matchName returns true if a name of a file matches a filter regexp or glob patterns of a rule.
+func (r *rule) matchName(name string) bool {
+	if r.glob != nil {
+		return matchGlobs(r.glob, name)
+	}
+
+	return r.name.MatchString(name)
+}
+
+// newGlobs parses gitignore style patterns, a pattern without a slash matches a file or a directory
+// at any depth, ** matches any count of directories, and a leading ! negates a previous pattern,
+// e.g: ["*.tf", "!modules/**"].
+func newGlobs(patterns []string) (gitignore.Matcher, error) {
+	ps := make([]gitignore.Pattern, 0, len(patterns))
+	for i, p := range patterns {
+		index := strconv.Itoa(i) // an invalid pattern is reported at it's index
+		trimmed := strings.Trim(strings.TrimPrefix(p, "!"), "/")
+		if trimmed == "" {
+			return nil, fieldErrorf(index, errors.Errorf("empty pattern %q", p), "")
+		}
+
+		for _, seg := range strings.Split(trimmed, "/") {
+			if seg == "**" {
+				continue
+			} else if strings.Contains(seg, "**") {
+				return nil, fieldErrorf(index, errors.Errorf("** must be a whole path segment in %q", p), "")
+			} else if _, err := filepath.Match(seg, ""); err != nil {
+				return nil, fieldErrorf(index, errors.Errorf("malformed pattern %q", p), "")
+			}
+		}
+
+		ps = append(ps, gitignore.ParsePattern(p, nil))
+	}
+
+	return gitignore.NewMatcher(ps), nil
+}
+
+// matchGlobs returns true if a file with name matches patterns, the last matching pattern wins.
+func matchGlobs(m gitignore.Matcher, name string) bool {
+	return m.Match(strings.Split(name, "/"), false)
+}
+
+// fileContent loads content of a file once, and decodes it to json or yaml documents once,
+// so several rules can match it.
+type fileContent struct {
+	f file
+
+	content []byte
+	read    bool
+	docs    []interface{}
+	decoded bool
+}
+
+// bytes returns content of a file.
+func (c *fileContent) bytes() ([]byte, error) {
+	if !c.read {
+		b, err := c.f.read()
+		if err != nil {
+			return nil, err
+		}
+		c.content, c.read = b, true
+	}
+
+	return c.content, nil
+}
+
+// documents returns documents of a json or a yaml file, other files and files that can't be decoded don't have them.
+// A document that can't be decoded is skipped, so a broken document of a yaml stream doesn't hide the ones after it.
+func (c *fileContent) documents() []interface{} {
+	if c.decoded {
+		return c.docs
+	}
+	c.decoded = true
+
+	switch strings.ToLower(path.Ext(c.f.Name)) {
+	case ".json", ".yaml", ".yml": // json is yaml too
+	default:
+		return nil
+	}
+
+	for _, y := range yamlDocuments(c.content) {
+		if doc, err := decodeDocument(y); err == nil && doc != nil {
+			c.docs = append(c.docs, doc)
+		}
+	}
+
+	return c.docs
+}
+
+// decodeDocument decodes a single json or yaml document, an empty document is nil.
+func decodeDocument(y []byte) (interface{}, error) {
+	js, err := yaml.YAMLToJSON(y)
+	if err != nil {
+		return nil, err
+	}
+
+	// numbers are decoded as json.Number, so they are compared with values as text, e.g: replicas: 3 is "3"
+	dec := stdjson.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var doc interface{}
+	if err = dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// yamlDocuments splits a yaml stream into documents by --- and ... markers at the start of a line, a marker there
+// always ends a document, since content of block scalars is indented. A parser can't go on after a syntax error,
+// so a stream is split first, and each document is decoded alone.
+func yamlDocuments(content []byte) [][]byte {
+	var docs [][]byte
+	start := 0
+	for off := 0; off < len(content); {
+		end := bytes.IndexByte(content[off:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += off + 1
+		}
+
+		line := bytes.TrimRight(content[off:end], "\r\n")
+		switch {
+		case isDocumentMarker(line, "---"): // content can follow it on the same line, e.g: --- {kind: Pod}
+			docs = append(docs, content[start:off])
+			start = off + len("---")
+		case isDocumentMarker(line, "..."):
+			docs = append(docs, content[start:off])
+			start = end
+		}
+		off = end
+	}
+
+	return append(docs, content[start:])
+}
+
+// isDocumentMarker returns true if a line is a marker, e.g: ---, or starts with it followed by a space, e.g: --- !tag.
+func isDocumentMarker(line []byte, marker string) bool {
+	return bytes.HasPrefix(line, []byte(marker)) && (len(line) == len(marker) || line[len(marker)] == ' ' || line[len(marker)] == '\t')
+}
+
+// hasKeys returns true if a document has all keys, and all keys of values with their values.
+func hasKeys(doc interface{}, keys []string, values map[string]string) bool {
+	for _, k := range keys {
+		if _, ok := lookup(doc, k); !ok {
+			return false
+		}
+	}
+
+	for k, want := range values {
+		v, ok := lookup(doc, k)
+		if !ok || fmt.Sprint(v) != want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookup returns a value of a dot separated key in a decoded json or yaml document.
+func lookup(doc interface{}, key string) (interface{}, bool) {
+	v := doc
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
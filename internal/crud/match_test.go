@@ -0,0 +1,230 @@
+package crud
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	deployment := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  replicas: 3\n"
+
+	tests := []struct {
+		name    string
+		conf    Config
+		file    string
+		content string
+		attrs   []string
+		want    bool
+	}{
+		{name: "filter", conf: Config{Filter: `\.ya?ml$`}, file: "app/deploy.yaml", want: true},
+		{name: "filter mismatch", conf: Config{Filter: `\.ya?ml$`}, file: "app/main.go"},
+		{name: "glob", conf: Config{Glob: []string{"*.tf"}}, file: "infra/modules/vpc/main.tf", want: true},
+		{name: "glob negation", conf: Config{Glob: []string{"*.tf", "!examples/**"}}, file: "examples/main.tf"},
+		{name: "exclude", conf: Config{Glob: []string{"*.tf"}, Exclude: []string{"vendor/"}}, file: "vendor/main.tf"},
+		{name: "attributes", conf: Config{Glob: []string{"*.go"}, Attributes: []string{"!vendored"}}, file: "lib.go", attrs: []string{AttrVendored}},
+		{
+			name:    "content regexp",
+			conf:    Config{Content: &ContentMatcher{Regexp: `kind:\s*Deployment`}},
+			file:    "deploy.yaml",
+			content: deployment,
+			want:    true,
+		},
+		{
+			name:    "content regexp mismatch",
+			conf:    Config{Content: &ContentMatcher{Regexp: `kind:\s*Service`}},
+			file:    "deploy.yaml",
+			content: deployment,
+		},
+		{
+			name:    "keys",
+			conf:    Config{Content: &ContentMatcher{Keys: []string{"apiVersion", "metadata.name"}}},
+			file:    "deploy.yaml",
+			content: deployment,
+			want:    true,
+		},
+		{
+			name:    "missing nested key",
+			conf:    Config{Content: &ContentMatcher{Keys: []string{"metadata.namespace"}}},
+			file:    "deploy.yaml",
+			content: deployment,
+		},
+		{
+			name:    "values",
+			conf:    Config{Content: &ContentMatcher{Values: map[string]string{"kind": "Deployment", "spec.replicas": "3"}}},
+			file:    "deploy.yaml",
+			content: deployment,
+			want:    true,
+		},
+		{
+			name:    "keys of another format",
+			conf:    Config{Content: &ContentMatcher{Keys: []string{"kind"}}},
+			file:    "deploy.txt",
+			content: deployment,
+		},
+		{
+			name:    "keys in one document",
+			conf:    Config{Content: &ContentMatcher{Keys: []string{"kind", "spec"}}},
+			file:    "all.yaml",
+			content: "kind: Service\n---\nspec: {}\n",
+		},
+		{
+			name:    "second document",
+			conf:    Config{Content: &ContentMatcher{Values: map[string]string{"kind": "Service"}}},
+			file:    "all.yaml",
+			content: "---\n" + deployment + "---\n# a comment only\n---\nkind: Service\n...\n",
+			want:    true,
+		},
+		{
+			name:    "document after a bad one",
+			conf:    Config{Content: &ContentMatcher{Values: map[string]string{"kind": "Service"}}},
+			file:    "all.yaml",
+			content: deployment + "---\nkind: [Pod\n---\nkind: Service\n",
+			want:    true,
+		},
+		{
+			name:    "document on a marker line",
+			conf:    Config{Content: &ContentMatcher{Values: map[string]string{"kind": "Pod"}}},
+			file:    "pod.yml",
+			content: "--- {kind: Pod}\n",
+			want:    true,
+		},
+		{
+			name:    "marker in a block scalar",
+			conf:    Config{Content: &ContentMatcher{Values: map[string]string{"kind": "ConfigMap"}}},
+			file:    "cm.yaml",
+			content: "kind: ConfigMap\ndata:\n  front: |\n    ---\n    title: x\n",
+			want:    true,
+		},
+		{
+			name:    "shebang",
+			conf:    Config{Content: &ContentMatcher{Shebang: `python3?$`}},
+			file:    "bin/run",
+			content: "#!/usr/bin/env python3\nprint()\n",
+			want:    true,
+		},
+		{
+			name:    "no shebang",
+			conf:    Config{Content: &ContentMatcher{Shebang: `python3?$`}},
+			file:    "run.py",
+			content: "# python3\nprint()\n",
+		},
+		{
+			name:    "match all",
+			conf:    Config{Glob: []string{"*.yaml"}, Content: &ContentMatcher{Keys: []string{"kind"}}},
+			file:    "deploy.yml",
+			content: deployment,
+		},
+		{
+			name:    "match any by name",
+			conf:    Config{Glob: []string{"*.yaml"}, Content: &ContentMatcher{Keys: []string{"jobs"}}, Match: MatchAny},
+			file:    "deploy.yaml",
+			content: deployment,
+			want:    true,
+		},
+		{
+			name:    "match any by content",
+			conf:    Config{Glob: []string{"*.yaml"}, Content: &ContentMatcher{Keys: []string{"kind"}}, Match: MatchAny},
+			file:    "deploy.yml",
+			content: deployment,
+			want:    true,
+		},
+		{
+			name:    "binary content",
+			conf:    Config{Content: &ContentMatcher{Regexp: `ELF`}},
+			file:    "bin/app",
+			content: "\x7fELF",
+			attrs:   []string{AttrBinary},
+		},
+		{name: "type", conf: Config{Type: "kubernetes"}, file: "k8s/deploy.yaml", content: deployment, want: true},
+		{name: "type mismatch", conf: Config{Type: "kubernetes"}, file: "docker-compose.yaml", content: "services: {}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRule(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := contentFile(tt.file, tt.content)
+			f.Attributes = tt.attrs
+			got, err := r.match(f, &fileContent{f: f})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRuleErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  Config
+		field string
+	}{
+		{name: "filter", conf: Config{Filter: "("}, field: "filter"},
+		{name: "glob", conf: Config{Glob: []string{"*.tf", "a**"}}, field: "glob.1"},
+		{name: "empty glob", conf: Config{Glob: []string{"/"}}, field: "glob.0"},
+		{name: "exclude", conf: Config{Filter: ".", Exclude: []string{"["}}, field: "exclude.0"},
+		{name: "filter and glob", conf: Config{Filter: ".", Glob: []string{"*"}}, field: "glob"},
+		{name: "match", conf: Config{Filter: ".", Match: "some"}, field: "match"},
+		{name: "content regexp", conf: Config{Content: &ContentMatcher{Regexp: "["}}, field: "content.regexp"},
+		{name: "shebang", conf: Config{Content: &ContentMatcher{Shebang: "("}}, field: "content.shebang"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRule(tt.conf)
+			fe, ok := err.(*fieldError)
+			if !ok {
+				t.Fatalf("got %v, want a field error", err)
+			}
+			if fe.field != tt.field {
+				t.Errorf("got field %q, want %q", fe.field, tt.field)
+			}
+		})
+	}
+}
+
+func TestYAMLDocuments(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{name: "single", content: "a: 1\n", want: []string{"a: 1\n"}},
+		{name: "leading marker", content: "---\na: 1\n", want: []string{"", "\na: 1\n"}},
+		{name: "markers", content: "a: 1\n---\nb: 2\n--- \r\nc: 3", want: []string{"a: 1\n", "\nb: 2\n", " \r\nc: 3"}},
+		{name: "content on a marker line", content: "--- !!map\na: 1\n", want: []string{"", " !!map\na: 1\n"}},
+		{name: "document end", content: "a: 1\n...\n---\nb: 2\n", want: []string{"a: 1\n", "", "\nb: 2\n"}},
+		{name: "not a marker", content: "a: ---\n----\n  ---\n", want: []string{"a: ---\n----\n  ---\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range yamlDocuments([]byte(tt.content)) {
+				got = append(got, string(d))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// contentFile returns a file with name whose content is read from content.
+func contentFile(name, content string) file {
+	return file{
+		Name: name,
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader([]byte(content))), nil
+		},
+	}
+}
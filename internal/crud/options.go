@@ -0,0 +1,123 @@
+package crud
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Stage is a step of scanning a repository or filtering it's files.
+type Stage string
+
+// Stages reported to ProgressFunc, in order they happen.
+const (
+	StageCloning    Stage = "cloning"
+	StageIndexing   Stage = "indexing"
+	StageFiltering  Stage = "filtering"
+	StageEvaluating Stage = "evaluating"
+)
+
+// ProgressFunc is called with a current stage and a percent of that stage that is done.
+type ProgressFunc func(stage Stage, percent int)
+
+// report calls p if it isn't nil.
+func (p ProgressFunc) report(stage Stage, percent int) {
+	if p != nil {
+		p(stage, percent)
+	}
+}
+
+// Options holds optional settings of GetGitCollectionContext.
+type Options struct {
+	Progress ProgressFunc  // called when cloning and indexing progresses
+	Auth     *Credentials  // used to clone private repositories, credentials in a url take precedence over it
+	Fetch    FetchPolicy   // when a cached repository is fetched, always by default
+	Clone    CloneStrategy // how a repository is cloned and cached, a full clone by default
+	Cache    *Cache        // where a repository is cached, DefaultCache if it's nil
+	Source   SourceMode    // which files of a local repository are read, a commit by default
+	Include  []string      // directories that are scanned besides dir argument, relative to a repository root
+	Exclude  []string      // directories that are skipped, even if they are inside included ones
+
+	// MaxBlobSize is a size of the largest file which content is read, in bytes. Larger files are indexed,
+	// but they get StatusTooLarge instead of being filtered. DefaultMaxBlobSize if it's 0, negative means no limit.
+	MaxBlobSize int64
+
+	// Workers is a count of goroutines that read files and detect their languages and attributes, runtime.NumCPU()
+	// if it's 0, 1 indexes files serially. A tree is walked serially, blobs are read by workers at once, see blobReaders.
+	Workers int
+
+	// PolicyDir is a directory of a repository all rego modules and data documents of a policy are loaded from,
+	// relative to a repository root, DefaultPolicyDir if it's empty, / means a whole repository,
+	// or only Include directories of it, if they are set.
+	PolicyDir string
+}
+
+// FilterOptions holds optional settings of FilterContext.
+type FilterOptions struct {
+	Progress ProgressFunc // called when filtering and evaluating progresses
+
+	// Exclude are gitignore style patterns of files no rule matches, e.g: ["vendor/**", "testdata/"].
+	Exclude []string
+
+	// FirstMatch tells to match each file only by the first rule it matches, in order of configs,
+	// by default a file is matched by all of them.
+	FirstMatch bool
+
+	// Namespace is a package of policies deny, warn and violation rules are evaluated in,
+	// DefaultNamespace if it's empty. Config.Namespace overrides it.
+	Namespace string
+
+	// Policies tells where policies of rules that don't have one are loaded from, if it's nil,
+	// a policy of a repository or a built in default policy is used.
+	Policies *PolicyChain
+}
+
+// namespace returns a package policies are evaluated in.
+func (o *FilterOptions) namespace() string {
+	if o.Namespace == "" {
+		return DefaultNamespace
+	}
+
+	return o.Namespace
+}
+
+// cloneProgressRegexp matches a progress line written by git server, e.g: Receiving objects:  45% (9/20)
+var cloneProgressRegexp = regexp.MustCompile(`(Counting|Compressing|Receiving|Resolving) (?:objects|deltas):\s+(\d+)%`)
+
+// cloneSteps maps each step of git clone to the part of a whole clone it represents.
+var cloneSteps = map[string][2]int{
+	"Counting":    {0, 10},
+	"Compressing": {10, 20},
+	"Receiving":   {20, 90},
+	"Resolving":   {90, 100},
+}
+
+// progressWriter is an io.Writer that parses a sideband progress of git clone,
+// and reports it as a percent of cloning stage.
+type progressWriter struct {
+	mu       sync.Mutex
+	progress ProgressFunc
+	last     int
+}
+
+// Write implements io.Writer.
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, m := range cloneProgressRegexp.FindAllSubmatch(p, -1) {
+		step := cloneSteps[string(m[1])]
+		percent, err := strconv.Atoi(string(m[2]))
+		if err != nil {
+			continue
+		}
+
+		total := step[0] + (step[1]-step[0])*percent/100
+		if total > w.last {
+			w.last = total
+			w.progress.report(StageCloning, total)
+		}
+	}
+
+	return len(p), nil
+}
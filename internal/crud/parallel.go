@@ -0,0 +1,84 @@
+package crud
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// workers returns a count of goroutines that index files, it's never less than 1.
+func (o *Options) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+
+	return runtime.NumCPU()
+}
+
+// parallel calls f for each index in [0, n) on at most workers goroutines. It stops at the first error,
+// or when ctx is done, and returns that error. f must only write results to it's own index,
+// so the order of results doesn't depend on the order goroutines finish.
+func parallel(ctx context.Context, n, workers int, f func(ctx context.Context, i int) error) error {
+	if workers > n {
+		workers = n
+	}
+
+	// a single worker runs in the caller's goroutine, so serial indexing doesn't pay for channels
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := f(ctx, i); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := f(ctx, i); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,248 @@
+package crud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	opautil "github.com/open-policy-agent/opa/util"
+	"github.com/pkg/errors"
+)
+
+// DefaultPolicyDir is a directory of a repository policies are loaded from, if Options.PolicyDir isn't set.
+const DefaultPolicyDir = "policy"
+
+// policyDataFiles are names of data documents that are loaded with modules of a policy,
+// a document of a directory a/b is put at data.a.b like in OPA bundles.
+var policyDataFiles = []string{"data.json", "data.yaml", "data.yml"}
+
+// Policy is a set of rego modules and data documents they use, they are compiled and evaluated together,
+// so modules can import each other and data.
+type Policy struct {
+	Name    string                 // where a policy is from, e.g: policy/ or a url
+	Version string                 // a commit or a bundle revision, if it's known
+	Modules map[string]string      // sources of modules by their file names
+	Data    map[string]interface{} // data documents
+
+	// sum is a digest of modules and data, it's computed once, when a policy isn't changed anymore
+	sum     string
+	sumOnce sync.Once
+}
+
+// policyDir returns a directory of a repository a policy is loaded from, relative to a root, empty for a root.
+func (o *Options) policyDir() string {
+	dir := o.PolicyDir
+	if dir == "" {
+		dir = DefaultPolicyDir
+	}
+
+	return strings.Trim(path.Clean("/"+dir), "/")
+}
+
+// newPolicy returns an empty policy.
+func newPolicy(name string) *Policy {
+	return &Policy{Name: name, Modules: make(map[string]string), Data: make(map[string]interface{})}
+}
+
+// isPolicyModule returns true if a file is a rego module, but not a test of one.
+func isPolicyModule(name string) bool {
+	return path.Ext(name) == ".rego" && !strings.HasSuffix(name, "_test.rego")
+}
+
+// isPolicyData returns true if a file is a data document of a policy.
+func isPolicyData(name string) bool {
+	base := path.Base(name)
+	for _, n := range policyDataFiles {
+		if base == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addData decodes a json or yaml document and puts it in data at a directory of name,
+// relative to a root of a policy, objects of documents are merged.
+func (p *Policy) addData(name string, content []byte) error {
+	var value interface{}
+	if err := opautil.Unmarshal(content, &value); err != nil {
+		return errors.Wrapf(err, "decoding %s", name)
+	}
+
+	var key []string
+	if dir := strings.Trim(path.Dir(name), "/."); dir != "" {
+		key = strings.Split(dir, "/")
+	}
+
+	if len(key) == 0 {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s in a root directory must be an object", name)
+		}
+		return mergeData(p.Data, obj, name)
+	}
+
+	parent := p.Data
+	for _, k := range key[:len(key)-1] {
+		child, ok := parent[k].(map[string]interface{})
+		if !ok {
+			if _, exists := parent[k]; exists {
+				return errors.Errorf("%s conflicts with data at %s", name, k)
+			}
+			child = make(map[string]interface{})
+			parent[k] = child
+		}
+		parent = child
+	}
+
+	last := key[len(key)-1]
+	existing, ok := parent[last].(map[string]interface{})
+	obj, isObj := value.(map[string]interface{})
+	switch {
+	case parent[last] == nil:
+		parent[last] = value
+	case ok && isObj:
+		return mergeData(existing, obj, name)
+	default:
+		return errors.Errorf("%s conflicts with data at %s", name, strings.Join(key, "."))
+	}
+
+	return nil
+}
+
+// mergeData merges src object into dst, nested objects are merged too, other values can't be overwritten.
+func mergeData(dst, src map[string]interface{}, name string) error {
+	for k, v := range src {
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+
+		a, aok := existing.(map[string]interface{})
+		b, bok := v.(map[string]interface{})
+		if !aok || !bok {
+			return errors.Errorf("%s conflicts with data at %s", name, k)
+		}
+		if err := mergeData(a, b, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readRepoPolicy loads all modules and data documents under dir of a repository into a policy,
+// tests of modules are skipped. It returns nil if there are no modules.
+func readRepoPolicy(files []sourceFile, dir string) (*Policy, error) {
+	var op = "crud.readRepoPolicy"
+
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
+	p := newPolicy(prefix)
+	if dir == "" {
+		p.Name = "/"
+	}
+
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, prefix) || !(isPolicyModule(f.Name) || isPolicyData(f.Name)) {
+			continue
+		}
+
+		content, err := f.read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): reading %s", op, f.Name)
+		}
+
+		if isPolicyModule(f.Name) {
+			p.Modules[f.Name] = string(content)
+		} else if err = p.addData(strings.TrimPrefix(f.Name, prefix), content); err != nil {
+			return nil, errors.Wrapf(err, "(%s)", op)
+		}
+	}
+
+	if len(p.Modules) == 0 {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+// readPolicyBundle reads an OPA bundle tarball into a policy.
+func readPolicyBundle(name string, r io.Reader) (*Policy, error) {
+	var op = "crud.readPolicyBundle"
+
+	b, err := bundle.NewReader(r).Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): reading bundle %s", op, name)
+	}
+
+	p := newPolicy(name)
+	p.Version = b.Manifest.Revision
+	p.Data = b.Data
+	for _, m := range b.Modules {
+		p.Modules[m.Path] = string(m.Raw)
+	}
+	if len(p.Modules) == 0 {
+		return nil, errors.Errorf("(%s): bundle %s doesn't have modules", op, name)
+	}
+
+	return p, nil
+}
+
+// isGzip returns true if content starts with a gzip header, bundles are gzipped tarballs.
+func isGzip(content []byte) bool {
+	return len(content) > 2 && content[0] == 0x1f && content[1] == 0x8b
+}
+
+// readPolicyFile reads a policy from a file on disk, it's either a rego module or a bundle.
+func readPolicyFile(name string) (*Policy, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePolicy(name, content)
+}
+
+// parsePolicy returns a policy of a bundle or of a single module.
+func parsePolicy(name string, content []byte) (*Policy, error) {
+	if isGzip(content) {
+		return readPolicyBundle(name, bytes.NewReader(content))
+	}
+
+	p := newPolicy(name)
+	p.Modules[name] = string(content)
+
+	return p, nil
+}
+
+// prepare compiles a query with all modules and data of a policy, so it can be evaluated on many inputs.
+func (p *Policy) prepare(ctx context.Context, query string) (rego.PreparedEvalQuery, error) {
+	names := make([]string, 0, len(p.Modules))
+	for n := range p.Modules {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	opts := []func(*rego.Rego){
+		rego.Query(query),
+		rego.Store(inmem.NewFromObject(p.Data)),
+	}
+	for _, n := range names {
+		opts = append(opts, rego.Module(n, p.Modules[n]))
+	}
+
+	return rego.New(opts...).PrepareForEval(ctx)
+}
@@ -0,0 +1,244 @@
+package crud
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/pkg/errors"
+)
+
+// DefaultPolicyTimeout is how long retrieving a policy from a url can take, if a cache doesn't set one.
+const DefaultPolicyTimeout = 30 * time.Second
+
+// maxCachedPolicies is a count of sources and of compiled queries a policy cache keeps, when there are more,
+// all of them are dropped, so policies of rules of api requests can't grow it without a limit.
+const maxCachedPolicies = 512
+
+// PolicyCache keeps policies of sources and queries compiled from them, so a policy is retrieved once per filter
+// and compiled once, until it's source changes. Urls are revalidated with ETag and Last-Modified headers,
+// files on disk by their modification time, and git sources by a fetch policy of PolicyChain.Git.
+// It's safe for concurrent use by several filters.
+type PolicyCache struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	sources map[string]*cachedPolicy           // by a source
+	queries map[string]*rego.PreparedEvalQuery // by a digest of a policy and a query
+}
+
+// cachedPolicy is a policy of a source, and what it's revalidated with.
+type cachedPolicy struct {
+	policy *Policy
+
+	etag         string    // of a url
+	lastModified string    // of a url
+	modTime      time.Time // of a file on disk
+	size         int64     // of a file on disk
+	checked      time.Time // when a git source was last fetched
+}
+
+var (
+	defaultPolicyCache     *PolicyCache
+	defaultPolicyCacheOnce sync.Once
+)
+
+// DefaultPolicyCache returns a cache with DefaultPolicyTimeout, it's used when PolicyChain.Cache is nil.
+func DefaultPolicyCache() *PolicyCache {
+	defaultPolicyCacheOnce.Do(func() {
+		defaultPolicyCache = NewPolicyCache(0)
+	})
+
+	return defaultPolicyCache
+}
+
+// NewPolicyCache returns an empty cache, policies are retrieved from urls with timeout, DefaultPolicyTimeout if it's 0.
+func NewPolicyCache(timeout time.Duration) *PolicyCache {
+	if timeout <= 0 {
+		timeout = DefaultPolicyTimeout
+	}
+
+	return &PolicyCache{
+		client:  &http.Client{Timeout: timeout},
+		sources: make(map[string]*cachedPolicy),
+		queries: make(map[string]*rego.PreparedEvalQuery),
+	}
+}
+
+// Purge drops all cached policies and compiled queries.
+func (c *PolicyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sources = make(map[string]*cachedPolicy)
+	c.queries = make(map[string]*rego.PreparedEvalQuery)
+}
+
+// cached returns a cached policy of a source, nil if there isn't one.
+func (c *PolicyCache) cached(key string) *cachedPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sources[key]
+}
+
+// store caches a policy of a source.
+func (c *PolicyCache) store(key string, entry *cachedPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sources) >= maxCachedPolicies {
+		c.sources = make(map[string]*cachedPolicy)
+	}
+	c.sources[key] = entry
+}
+
+// load returns a policy of a source, it's retrieved again only if it changed since it was cached.
+// Git sources are cloned with chain options, and cached separately for each of credentials,
+// so a policy of a private repository isn't given to users without them, see gitPolicyCredentials.
+func (c *PolicyCache) load(ctx context.Context, src *PolicySource, chain *PolicyChain, trusted bool) (*Policy, error) {
+	name := src.String()
+	key := name
+
+	var url string
+	var creds *Credentials
+	if src.Git != nil {
+		url, creds = gitPolicyCredentials(src.Git, chain, trusted)
+		if fp := creds.fingerprint(); fp != "" {
+			key += "#" + fp
+		}
+	}
+	entry := c.cached(key)
+
+	var fresh *cachedPolicy
+	var err error
+	switch {
+	case src.URL != "":
+		fresh, err = c.getURL(ctx, src.URL, entry)
+	case src.Git != nil:
+		if entry != nil && !chain.Git.Fetch.needsFetch(entry.checked) {
+			return entry.policy, nil
+		}
+		fresh = &cachedPolicy{checked: time.Now()}
+		fresh.policy, err = loadGitPolicy(ctx, src.Git, url, creds, chain)
+	default:
+		fresh, err = readPolicySource(src.Path, entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fresh != entry {
+		fresh.policy.Name = name
+		c.store(key, fresh)
+	}
+
+	return fresh.policy, nil
+}
+
+// getURL retrieves a policy from url, it's either a rego module or a bundle. If a cached entry is given,
+// a request is conditional, and the entry is returned if a policy didn't change.
+func (c *PolicyCache) getURL(ctx context.Context, url string, entry *cachedPolicy) (*cachedPolicy, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		return entry, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if len(content) == 0 {
+		return nil, errors.New("no bytes copied from response")
+	}
+
+	p, err := parsePolicy(url, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedPolicy{
+		policy:       p,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// readPolicySource reads a policy from a path on disk, a cached entry of a file is returned if it's
+// modification time and size didn't change. Directories are read again, but their compiled queries are kept
+// if their modules and data didn't change.
+func readPolicySource(path string, entry *cachedPolicy) (*cachedPolicy, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		p, err := readPolicyPath(path)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedPolicy{policy: p}, nil
+	}
+
+	if entry != nil && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry, nil
+	}
+
+	p, err := readPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedPolicy{policy: p, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// eval evaluates a query of a policy on input, the query is compiled with all modules and data of the policy
+// the first time it's evaluated, and it's reused by all files and filters while the policy doesn't change.
+func (c *PolicyCache) eval(ctx context.Context, p *Policy, query string, input interface{}) (rego.ResultSet, error) {
+	key := p.digest() + "\x00" + query
+
+	c.mu.Lock()
+	pq, ok := c.queries[key]
+	c.mu.Unlock()
+
+	if !ok {
+		prepared, err := p.prepare(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		pq = &prepared
+
+		c.mu.Lock()
+		if len(c.queries) >= maxCachedPolicies {
+			c.queries = make(map[string]*rego.PreparedEvalQuery)
+		}
+		c.queries[key] = pq
+		c.mu.Unlock()
+	}
+
+	return pq.Eval(ctx, rego.EvalInput(input))
+}
@@ -0,0 +1,436 @@
+package crud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// Steps of a policy resolution chain, in order they are tried.
+const (
+	PolicyStepRule    = "rule"    // a policy of a rule, Config.PolicyURL
+	PolicyStepRepo    = "repo"    // a policy directory of a scanned repository
+	PolicyStepOrg     = "org"     // an organization policy, PolicyChain.Org
+	PolicyStepDefault = "default" // a default policy of a server, PolicyChain.Default
+)
+
+// gitSourcePrefix starts a git policy source, e.g: git::https://github.com/org/policies//k8s?ref=v1.2.0
+const gitSourcePrefix = "git::"
+
+// PolicySource is a place a policy is loaded from: a url of a module or a bundle, a path of a module,
+// a bundle or a directory on disk, or a directory of a git repository at a ref. Exactly one of them is set.
+type PolicySource struct {
+	URL  string
+	Path string
+	Git  *GitPolicySource
+}
+
+// GitPolicySource is a policy directory of a git repository at a ref, e.g: a tag or a commit it's pinned to.
+type GitPolicySource struct {
+	URL string
+	Ref string // HEAD if it's empty
+	Dir string // a root of a repository if it's empty
+}
+
+// ParsePolicySource parses a policy source from a url, e.g: https://example.com/k8s.rego,
+// a git source, e.g: git::https://github.com/org/policies//k8s?ref=v1.2.0, or a path on disk.
+func ParsePolicySource(s string) (*PolicySource, error) {
+	var op = "crud.ParsePolicySource"
+
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, errors.Errorf("(%s): empty policy source", op)
+	case strings.HasPrefix(s, "http://"), strings.HasPrefix(s, "https://"):
+		return &PolicySource{URL: s}, nil
+	case !strings.HasPrefix(s, gitSourcePrefix):
+		return &PolicySource{Path: s}, nil
+	}
+
+	src := &GitPolicySource{URL: strings.TrimPrefix(s, gitSourcePrefix)}
+	if i := strings.LastIndex(src.URL, "?ref="); i >= 0 {
+		src.URL, src.Ref = src.URL[:i], src.URL[i+len("?ref="):]
+	}
+
+	// a directory is separated by a double slash, that isn't a part of a scheme, e.g: https://host/repo//dir
+	start := 0
+	if i := strings.Index(src.URL, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	if i := strings.Index(src.URL[start:], "//"); i >= 0 {
+		src.URL, src.Dir = src.URL[:start+i], strings.Trim(src.URL[start+i+2:], "/")
+	}
+	if src.URL == "" {
+		return nil, errors.Errorf("(%s): git policy source %q doesn't have a url", op, s)
+	}
+
+	return &PolicySource{Git: src}, nil
+}
+
+// String returns a source in the same form ParsePolicySource accepts.
+func (s *PolicySource) String() string {
+	switch {
+	case s.URL != "":
+		return s.URL
+	case s.Git != nil:
+		str := gitSourcePrefix + s.Git.URL
+		if s.Git.Dir != "" {
+			str += "//" + s.Git.Dir
+		}
+		if s.Git.Ref != "" {
+			str += "?ref=" + s.Git.Ref
+		}
+		return str
+	}
+
+	return s.Path
+}
+
+// UnmarshalJSON implements json.Unmarshaler, a source is decoded from a string accepted by ParsePolicySource.
+func (s *PolicySource) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+
+	src, err := ParsePolicySource(str)
+	if err != nil {
+		return err
+	}
+	*s = *src
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s PolicySource) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// PolicyChain tells where policies are loaded from. A policy of a rule is used if it has one,
+// then a policy directory of a repository, then an organization policy, then a default policy.
+type PolicyChain struct {
+	Org     *PolicySource // optional, e.g: a git repository of an organization at a pinned ref
+	Default *PolicySource // optional, a built in policy that doesn't deny anything if it isn't set
+
+	// LocalRules tells if policies of rules can be paths on disk, only rules of trusted users can read them,
+	// e.g: in cli, but not in api requests.
+	LocalRules bool
+
+	// Git holds options git sources are cloned with, credentials are taken from Hosts if neither a url
+	// of a source nor Git.Auth has them. Git sources of rules only get credentials of Hosts that list their
+	// repositories, unless LocalRules is set, see HostCredentials.Shared.
+	// A git source is cloned again only if Git.Fetch tells it's time to fetch it.
+	Git   Options
+	Hosts HostCredentials
+
+	// Cache keeps policies of sources and their compiled queries between filters, DefaultPolicyCache if it's nil.
+	Cache *PolicyCache
+}
+
+// PolicyProvenance tells which policy was applied to a file, and where it's from.
+type PolicyProvenance struct {
+	Step    string   `json:"step"`    // rule, repo, org or default
+	Source  string   `json:"source"`  // e.g: https://example.com/k8s.rego, policy/ or git::https://host/repo//dir?ref=v1
+	Version string   `json:"version"` // commit of a git source, revision of a bundle, or a digest of modules and data
+	Modules []string `json:"modules"` // files of modules that were compiled together
+}
+
+// provenance returns a provenance of a policy that was resolved at a step.
+func (p *Policy) provenance(step string) *PolicyProvenance {
+	modules := make([]string, 0, len(p.Modules))
+	for n := range p.Modules {
+		modules = append(modules, n)
+	}
+	sort.Strings(modules)
+
+	version := p.Version
+	if version == "" {
+		version = p.digest()[:len("sha256:")+16]
+	}
+
+	return &PolicyProvenance{Step: step, Source: p.Name, Version: version, Modules: modules}
+}
+
+// digest returns a sha256 of modules and data of a policy, it changes if any of them change.
+// It's computed once, so a policy must not be changed after it's first used.
+func (p *Policy) digest() string {
+	p.sumOnce.Do(func() {
+		p.sum = p.computeDigest()
+	})
+
+	return p.sum
+}
+
+// computeDigest hashes names and sources of modules and data of a policy.
+func (p *Policy) computeDigest() string {
+	h := sha256.New()
+
+	names := make([]string, 0, len(p.Modules))
+	for n := range p.Modules {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		h.Write([]byte(n))
+		h.Write([]byte{0})
+		h.Write([]byte(p.Modules[n]))
+		h.Write([]byte{0})
+	}
+
+	data, _ := json.Marshal(p.Data) // keys of maps are sorted
+	h.Write(data)
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// policyResolver resolves policies of rules by a chain, each source is loaded once per filter.
+type policyResolver struct {
+	chain  *PolicyChain
+	cache  *PolicyCache
+	coll   *GitCollection
+	loaded map[string]*Policy
+}
+
+// newPolicyResolver returns a resolver of policies of a collection, chain can be nil.
+func newPolicyResolver(coll *GitCollection, chain *PolicyChain) *policyResolver {
+	if chain == nil {
+		chain = &PolicyChain{}
+	}
+
+	cache := chain.Cache
+	if cache == nil {
+		cache = DefaultPolicyCache()
+	}
+
+	return &policyResolver{chain: chain, cache: cache, coll: coll, loaded: make(map[string]*Policy)}
+}
+
+// resolve returns a policy of a config, and a step of a chain it was found at.
+func (r *policyResolver) resolve(ctx context.Context, conf Config) (*Policy, string, error) {
+	if conf.PolicyURL != "" {
+		src, err := ParsePolicySource(conf.PolicyURL)
+		if err != nil {
+			return nil, "", err
+		}
+		if !r.chain.LocalRules {
+			if src.Path != "" {
+				return nil, "", errors.Errorf("policy %q of a rule must be a url or a git source", conf.PolicyURL)
+			} else if src.Git != nil && !remoteGitURL(src.Git.URL) {
+				return nil, "", errors.Errorf("git policy %q of a rule must be cloned over https, ssh or git", conf.PolicyURL)
+			}
+		}
+
+		p, err := r.load(ctx, src, r.chain.LocalRules)
+		return p, PolicyStepRule, err
+	}
+
+	if r.coll.policyErr != nil {
+		return nil, "", errors.Wrap(r.coll.policyErr, "reading a policy of a repository")
+	}
+	if r.coll.Policy != nil {
+		return r.coll.Policy, PolicyStepRepo, nil
+	}
+
+	if r.chain.Org != nil {
+		p, err := r.load(ctx, r.chain.Org, true)
+		return p, PolicyStepOrg, err
+	}
+
+	if r.chain.Default == nil {
+		return builtinPolicy, PolicyStepDefault, nil
+	}
+	p, err := r.load(ctx, r.chain.Default, true)
+
+	return p, PolicyStepDefault, err
+}
+
+// remoteGitURL returns true if a repository of a url is cloned over https, ssh or git protocol,
+// e.g: https://host/repo or git@host:repo, and not from a path on disk.
+func remoteGitURL(url string) bool {
+	url, _ = stripCredentials(url)
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return false
+	}
+
+	switch ep.Protocol {
+	case "https", "ssh", "git":
+		return ep.Host != ""
+	}
+
+	return false
+}
+
+// BuiltinPolicyName is a source of a default policy that's built in, it's used when PolicyChain.Default isn't set.
+const BuiltinPolicyName = "builtin:default.rego"
+
+// builtinPolicyModule is a module of a built in default policy.
+const builtinPolicyModule = `package main
+
+# a built in default policy is applied when no step of a chain has a policy, it doesn't deny anything.
+# Policies return messages from deny, violation and warn rules, e.g:
+#
+# deny[msg] {
+#   input.kind == "Deployment"
+#   not input.spec.template.spec.securityContext.runAsNonRoot
+#   msg := "containers must not run as root"
+# }
+
+deny := set()
+`
+
+// builtinPolicy is a default policy that's built in, it's never changed, so it's shared by all filters.
+var builtinPolicy = func() *Policy {
+	p := newPolicy(BuiltinPolicyName)
+	p.Modules[BuiltinPolicyName] = builtinPolicyModule
+
+	return p
+}()
+
+// load returns a policy of a source, it's revalidated in a cache only the first time in a filter.
+// Sources of server config and of trusted users are trusted, they are cloned with any credentials of hosts.
+func (r *policyResolver) load(ctx context.Context, src *PolicySource, trusted bool) (*Policy, error) {
+	// a source of a rule can be cloned with fewer credentials than the same source of server config
+	key := fmt.Sprintf("%t %s", trusted, src)
+	if p, ok := r.loaded[key]; ok {
+		return p, nil
+	}
+
+	p, err := r.cache.load(ctx, src, r.chain, trusted)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading policy %s", src)
+	}
+	r.loaded[key] = p
+
+	return p, nil
+}
+
+// eval evaluates a query of a policy on input with a query compiled by a cache.
+func (r *policyResolver) eval(ctx context.Context, p *Policy, query string, input interface{}) (rego.ResultSet, error) {
+	return r.cache.eval(ctx, p, query, input)
+}
+
+// gitPolicyCredentials returns credentials a git source is cloned with, ones in it's url,
+// chain.Git.Auth or ones of it's host, only shared ones if a source isn't trusted.
+func gitPolicyCredentials(src *GitPolicySource, chain *PolicyChain, trusted bool) (string, *Credentials) {
+	url, creds := stripCredentials(src.URL)
+	switch {
+	case creds != nil:
+	case chain.Git.Auth != nil:
+		creds = chain.Git.Auth
+	case trusted:
+		creds = chain.Hosts.For(url)
+	default:
+		creds = chain.Hosts.Shared(url)
+	}
+
+	return url, creds
+}
+
+// loadGitPolicy clones a repository of a git source with creds and chain options, or refreshes a cached clone,
+// and reads a policy from it's directory at a ref, other files of a repository aren't read.
+func loadGitPolicy(ctx context.Context, src *GitPolicySource, url string, creds *Credentials, chain *PolicyChain) (*Policy, error) {
+	auth, err := authMethod(url, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := chain.Git.Cache
+	if cache == nil {
+		cache = DefaultCache()
+	}
+	r, _, release, err := openRepository(ctx, url, src.Ref, chain.Git.Clone, chain.Git.Fetch, auth, creds.fingerprint(), cache, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	commit, info, err := resolveRevision(r, src.Ref, true)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := strings.Trim(path.Clean("/"+src.Dir), "/")
+	prefix := ""
+	if dir != "" {
+		if tree, err = tree.Tree(dir); err == object.ErrDirectoryNotFound {
+			return nil, errors.Errorf("%s doesn't have %s at %s", url, dir, info.Hash)
+		} else if err != nil {
+			return nil, err
+		}
+		prefix = dir + "/"
+	}
+
+	files, err := treeFiles(ctx, tree, prefix, newBlobReaders(r))
+	if err != nil {
+		return nil, err
+	}
+	p, err := readRepoPolicy(files, dir)
+	if err != nil {
+		return nil, err
+	} else if p == nil {
+		return nil, errors.Errorf("%s doesn't have rego modules at %s", url, info.Hash)
+	}
+	p.Version = info.Hash
+
+	return p, nil
+}
+
+// readPolicyPath reads a policy from a path on disk, a rego module, a bundle or a directory of them.
+func readPolicyPath(path string) (*Policy, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return readPolicyFile(path)
+	}
+
+	var files []sourceFile
+	err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{
+			Name: filepath.ToSlash(rel),
+			Size: info.Size(),
+			open: func() (io.ReadCloser, error) { return os.Open(name) },
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := readRepoPolicy(files, "")
+	if err != nil {
+		return nil, err
+	} else if p == nil {
+		return nil, errors.Errorf("%s doesn't have rego modules", path)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,134 @@
+package crud
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// repoConfigFiles are names of a filter config a repository can have in it's root directory,
+// the first one that exists is read.
+var repoConfigFiles = []string{".gitfilter.yaml", ".gitfilter.yml", ".gitfilter.json", ".gitfilter.toml"}
+
+// Merge modes tell how filter rules of a repository are combined with baseline rules of a server.
+const (
+	MergeRules    = "merge"    // baseline rules and repository rules, a repository rule replaces a baseline rule with the same name, default
+	MergeRepo     = "repo"     // repository rules if a repository has them, baseline rules otherwise
+	MergeBaseline = "baseline" // baseline rules only, repository rules are ignored
+)
+
+// ErrNoFilterConfig is used when filter rules aren't given, and neither a repository nor a server has them.
+var ErrNoFilterConfig = errors.New("no filter rules")
+
+// readRepoConfig finds a filter config in a root directory of a repository and parses it into RepoFilter.
+// An invalid config doesn't fail a scan, it's error is saved in RepoFilterError and reported when it's rules are used.
+func (coll *GitCollection) readRepoConfig(files []sourceFile) error {
+	var op = "crud.readRepoConfig"
+
+	byName := make(map[string]sourceFile)
+	for _, f := range files {
+		byName[f.Name] = f
+	}
+
+	for _, n := range repoConfigFiles {
+		f, ok := byName[n]
+		if !ok {
+			continue
+		}
+
+		content, err := f.read()
+		if err != nil {
+			return errors.Wrapf(err, "(%s): reading %s", op, n)
+		}
+
+		coll.RepoFilterName = n
+		if coll.RepoFilter, err = ParseFilterConfig(content, DetectFormat(n, "", content)); err != nil {
+			coll.RepoFilterError = err.Error()
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// ReadFilterConfig reads a filter config from a file, it's format is told by an extension.
+func ReadFilterConfig(path string) (*FilterConfig, error) {
+	var op = "crud.ReadFilterConfig"
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): reading %s", op, path)
+	}
+
+	conf, err := ParseFilterConfig(content, DetectFormat(filepath.Base(path), "", content))
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): %s", op, path)
+	}
+
+	return conf, nil
+}
+
+// ValidateMergeMode returns an error if a merge mode is unknown, an empty mode is MergeRules.
+func ValidateMergeMode(mode string) error {
+	switch mode {
+	case "", MergeRules, MergeRepo, MergeBaseline:
+		return nil
+	}
+
+	return errors.Errorf("(crud.ValidateMergeMode): unknown merge mode %q, must be %s, %s or %s", mode, MergeRules, MergeRepo, MergeBaseline)
+}
+
+// MergeFilterConfigs combines baseline rules of a server with rules of a repository in a mode,
+// either of them can be nil. Exclude patterns of both are kept in merge mode, first match is set if either sets it,
+// and a namespace of a repository takes precedence over a baseline one.
+func MergeFilterConfigs(baseline, repo *FilterConfig, mode string) *FilterConfig {
+	switch {
+	case mode == MergeBaseline || repo == nil:
+		return baseline
+	case mode == MergeRepo || baseline == nil:
+		return repo
+	}
+
+	merged := &FilterConfig{
+		Exclude:    append(append([]string{}, baseline.Exclude...), repo.Exclude...),
+		FirstMatch: baseline.FirstMatch || repo.FirstMatch,
+		Namespace:  repo.Namespace,
+	}
+	if merged.Namespace == "" {
+		merged.Namespace = baseline.Namespace
+	}
+
+	replaced := make(map[string]bool, len(repo.Config))
+	for _, c := range repo.Config {
+		replaced[c.Name] = true
+	}
+	for _, c := range baseline.Config {
+		if !replaced[c.Name] {
+			merged.Config = append(merged.Config, c)
+		}
+	}
+	merged.Config = append(merged.Config, repo.Config...)
+
+	return merged
+}
+
+// DefaultFilter returns rules a collection is filtered with when a user doesn't give them,
+// they are baseline rules of a server merged with rules of a repository in a mode.
+// It fails with ErrNoFilterConfig if neither of them has rules, and if a repository config is invalid,
+// unless it's ignored in baseline mode.
+func (c *GitCollection) DefaultFilter(baseline *FilterConfig, mode string) (*FilterConfig, error) {
+	var op = "crud.GitCollectionDefaultFilter"
+
+	if c.RepoFilterError != "" && mode != MergeBaseline {
+		return nil, errors.Errorf("(%s): invalid %s: %s", op, c.RepoFilterName, c.RepoFilterError)
+	}
+
+	conf := MergeFilterConfigs(baseline, c.RepoFilter, mode)
+	if conf == nil || len(conf.Config) == 0 {
+		return nil, errors.Wrapf(ErrNoFilterConfig, "(%s): a repository doesn't have %s, and a server doesn't have baseline rules", op, repoConfigFiles[0])
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,133 @@
+package crud
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMergeFilterConfigs(t *testing.T) {
+	baseline := &FilterConfig{
+		Config:    []Config{{Name: "k8s", Type: "kubernetes"}, {Name: "tf", Type: "terraform"}},
+		Exclude:   []string{"vendor/"},
+		Namespace: "baseline",
+	}
+	repo := &FilterConfig{
+		Config:     []Config{{Name: "tf", Glob: []string{"infra/*.tf"}}, {Name: "helm", Type: "helm"}},
+		Exclude:    []string{"examples/"},
+		FirstMatch: true,
+	}
+
+	tests := []struct {
+		name     string
+		baseline *FilterConfig
+		repo     *FilterConfig
+		mode     string
+		want     *FilterConfig
+	}{
+		{
+			name:     "merge replaces rules by name",
+			baseline: baseline,
+			repo:     repo,
+			mode:     MergeRules,
+			want: &FilterConfig{
+				Config:     []Config{{Name: "k8s", Type: "kubernetes"}, {Name: "tf", Glob: []string{"infra/*.tf"}}, {Name: "helm", Type: "helm"}},
+				Exclude:    []string{"vendor/", "examples/"},
+				FirstMatch: true,
+				Namespace:  "baseline",
+			},
+		},
+		{
+			name:     "empty mode is merge",
+			baseline: baseline,
+			repo:     &FilterConfig{Config: []Config{{Name: "k8s", Glob: []string{"k8s/"}}}, Namespace: "repo"},
+			want: &FilterConfig{
+				Config:    []Config{{Name: "tf", Type: "terraform"}, {Name: "k8s", Glob: []string{"k8s/"}}},
+				Exclude:   []string{"vendor/"},
+				Namespace: "repo",
+			},
+		},
+		{name: "merge without repo", baseline: baseline, mode: MergeRules, want: baseline},
+		{name: "merge without baseline", repo: repo, mode: MergeRules, want: repo},
+		{name: "repo", baseline: baseline, repo: repo, mode: MergeRepo, want: repo},
+		{name: "repo without repo", baseline: baseline, mode: MergeRepo, want: baseline},
+		{name: "baseline", baseline: baseline, repo: repo, mode: MergeBaseline, want: baseline},
+		{name: "baseline without baseline", repo: repo, mode: MergeBaseline},
+		{name: "neither", mode: MergeRules},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergeFilterConfigs(tt.baseline, tt.repo, tt.mode)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if len(baseline.Config) != 2 || len(baseline.Exclude) != 1 || len(repo.Exclude) != 1 {
+		t.Error("merging changed merged configs")
+	}
+}
+
+func TestDefaultFilter(t *testing.T) {
+	baseline := &FilterConfig{Config: []Config{{Name: "k8s", Type: "kubernetes"}}}
+	repo := &FilterConfig{Config: []Config{{Name: "tf", Type: "terraform"}}}
+
+	tests := []struct {
+		name     string
+		coll     *GitCollection
+		baseline *FilterConfig
+		mode     string
+		want     []string // names of rules
+		wantErr  bool
+		noRules  bool // an error is ErrNoFilterConfig
+	}{
+		{name: "merge", coll: &GitCollection{RepoFilter: repo}, baseline: baseline, mode: MergeRules, want: []string{"k8s", "tf"}},
+		{name: "repo", coll: &GitCollection{RepoFilter: repo}, baseline: baseline, mode: MergeRepo, want: []string{"tf"}},
+		{name: "baseline", coll: &GitCollection{RepoFilter: repo}, baseline: baseline, mode: MergeBaseline, want: []string{"k8s"}},
+		{name: "no repo config", coll: &GitCollection{}, baseline: baseline, mode: MergeRepo, want: []string{"k8s"}},
+		{name: "no rules", coll: &GitCollection{}, mode: MergeRules, wantErr: true, noRules: true},
+		{name: "empty rules", coll: &GitCollection{RepoFilter: &FilterConfig{}}, mode: MergeRepo, wantErr: true, noRules: true},
+		{name: "baseline without baseline", coll: &GitCollection{RepoFilter: repo}, mode: MergeBaseline, wantErr: true, noRules: true},
+		{
+			name:     "invalid repo config",
+			coll:     &GitCollection{RepoFilterName: ".gitfilter.yaml", RepoFilterError: "line 1: bad"},
+			baseline: baseline,
+			mode:     MergeRules,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid repo config is ignored by baseline",
+			coll:     &GitCollection{RepoFilterName: ".gitfilter.yaml", RepoFilterError: "line 1: bad"},
+			baseline: baseline,
+			mode:     MergeBaseline,
+			want:     []string{"k8s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := tt.coll.DefaultFilter(tt.baseline, tt.mode)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				} else if noRules := errors.Cause(err) == ErrNoFilterConfig; noRules != tt.noRules {
+					t.Fatalf("got %v, ErrNoFilterConfig %v", err, tt.noRules)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, c := range conf.Config {
+				got = append(got, c.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package crud
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// remoteName is a name of a remote that repositories are cloned from.
+const remoteName = "origin"
+
+var (
+	// ErrRevisionNotFound is used when a revision doesn't match any commit, branch or tag.
+	ErrRevisionNotFound = errors.New("revision not found")
+
+	// ErrAmbiguousRevision is used when an abbreviated hash matches several commits.
+	ErrAmbiguousRevision = errors.New("abbreviated hash is ambiguous")
+
+	// abbrevHashRegexp matches an abbreviated commit hash, git requires at least 4 characters.
+	abbrevHashRegexp = regexp.MustCompile(`^[0-9a-fA-F]{4,39}$`)
+)
+
+// commitInfo holds a resolved commit of a scanned revision, and it's metadata.
+type commitInfo struct {
+	Revision string `json:"revision"` // revision requested by user, e.g: main~3
+	Ref      string `json:"ref"`      // full name of a reference revision was resolved from, empty for hashes
+
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+}
+
+// Title returns the first line of a commit message.
+func (c *commitInfo) Title() string {
+	if i := strings.IndexByte(c.Message, '\n'); i != -1 {
+		return c.Message[:i]
+	}
+
+	return c.Message
+}
+
+// revisionBase returns a leading reference or hash of a revision, e.g: main for main~3.
+func revisionBase(rev string) (base, suffix string) {
+	if i := strings.IndexAny(rev, "~^@:"); i != -1 {
+		return rev[:i], rev[i:]
+	}
+
+	return rev, ""
+}
+
+// resolveRevision resolves a branch, a tag, a remote-tracking branch, a full or abbreviated hash,
+// or an expression like main~3 to a commit. An empty revision means HEAD.
+// If remote is true, e.g: in a cached clone, branches are resolved from their remote-tracking references first,
+// so main means origin/main, in a local repository of a user local branches are used like in git.
+func resolveRevision(r *git.Repository, rev string, remote bool) (*object.Commit, *commitInfo, error) {
+	var op = "crud.resolveRevision"
+
+	info := &commitInfo{Revision: rev}
+	if rev == "" {
+		rev = plumbing.HEAD.String()
+	}
+	base, suffix := revisionBase(rev)
+
+	// local HEAD of a cached clone isn't moved by fetch, so use the remote-tracking branch it points to
+	if remote && base == plumbing.HEAD.String() {
+		if head := remoteHead(r); head != "" {
+			base = head
+			rev = head + suffix
+		}
+	}
+
+	// remote-tracking branches are tried first, local branches of a cached clone are stale after fetch
+	candidates := []string{rev, ""}
+	if remote {
+		candidates = append([]string{remoteName + "/" + rev}, candidates...)
+	}
+	for _, c := range candidates {
+		// expand an abbreviated hash last, references take precedence over it like in git,
+		// and ResolveRevision only knows full hashes
+		if c == "" {
+			if !abbrevHashRegexp.MatchString(base) {
+				break
+			}
+
+			hash, err := expandHash(r, base)
+			if err == ErrRevisionNotFound {
+				break
+			} else if err != nil {
+				return nil, nil, errors.Wrapf(err, "(%s): %s", op, rev)
+			}
+			c = hash.String() + suffix
+		}
+
+		hash, err := r.ResolveRevision(plumbing.Revision(c))
+		if err != nil {
+			continue
+		}
+
+		commit, err := r.CommitObject(*hash)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "(%s): retrieving a commit object", op)
+		}
+
+		base, _ = revisionBase(c)
+		info.Ref = referenceName(r, base)
+		info.Hash = commit.Hash.String()
+		info.Author = commit.Author.Name
+		info.Email = commit.Author.Email
+		info.Date = commit.Author.When
+		info.Message = strings.TrimSpace(commit.Message)
+
+		return commit, info, nil
+	}
+
+	return nil, nil, errors.Wrapf(ErrRevisionNotFound, "(%s): %s", op, rev)
+}
+
+// remoteHead returns a name of a remote-tracking branch of the branch HEAD points to, e.g: origin/main,
+// or an empty string if HEAD is detached or there is no such remote-tracking branch.
+func remoteHead(r *git.Repository) string {
+	head, err := r.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return ""
+	}
+
+	name := plumbing.NewRemoteReferenceName(remoteName, head.Target().Short())
+	if _, err = r.Storer.Reference(name); err != nil {
+		return ""
+	}
+
+	return remoteName + "/" + head.Target().Short()
+}
+
+// referenceName returns a full name of a reference that name resolves to, using the same rules as git,
+// e.g: refs/tags/v1.0 for v1.0. It returns an empty string if name isn't a reference.
+func referenceName(r *git.Repository, name string) string {
+	for _, rule := range append([]string{"%s"}, plumbing.RefRevParseRules...) {
+		refName := plumbing.ReferenceName(strings.Replace(rule, "%s", name, 1))
+
+		ref, err := r.Storer.Reference(refName)
+		if err != nil {
+			continue
+		}
+
+		// a symbolic reference, e.g: HEAD, is reported as the branch it points to
+		if ref.Type() == plumbing.SymbolicReference {
+			if resolved, err := storer.ResolveReference(r.Storer, refName); err == nil {
+				return resolved.Name().String()
+			}
+		}
+
+		return ref.Name().String()
+	}
+
+	return ""
+}
+
+// expandHash returns a full hash of a commit or a tag whose hash starts with prefix.
+func expandHash(r *git.Repository, prefix string) (plumbing.Hash, error) {
+	var found []plumbing.Hash
+
+	prefix = strings.ToLower(prefix)
+	for _, t := range []plumbing.ObjectType{plumbing.CommitObject, plumbing.TagObject} {
+		iter, err := r.Storer.IterEncodedObjects(t)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		err = iter.ForEach(func(o plumbing.EncodedObject) error {
+			if strings.HasPrefix(o.Hash().String(), prefix) {
+				found = append(found, o.Hash())
+			}
+			return nil
+		})
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return plumbing.ZeroHash, ErrRevisionNotFound
+	case 1:
+		return found[0], nil
+	default:
+		return plumbing.ZeroHash, ErrAmbiguousRevision
+	}
+}
@@ -0,0 +1,86 @@
+package crud
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestResolveRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a cached clone after a fetch: origin/master is ahead of a stale local master
+	r := initRepo(t, dir)
+	first := commit(t, r, map[string]string{"a.txt": "a\n"})
+	second := commit(t, r, map[string]string{"b.txt": "b\n"})
+	r = pack(t, dir)
+
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(plumbing.Master, first),
+		plumbing.NewHashReference(plumbing.NewBranchReferenceName("dev"), first),
+		plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, "master"), second),
+		plumbing.NewHashReference(plumbing.NewRemoteReferenceName(remoteName, "feature"), second),
+		plumbing.NewHashReference(plumbing.NewTagReferenceName("v1"), first),
+	}
+	for _, ref := range refs {
+		if err = r.Storer.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		rev      string
+		remote   bool
+		want     plumbing.Hash
+		wantRef  string
+		notFound bool
+	}{
+		{name: "remote head", remote: true, want: second, wantRef: "refs/remotes/origin/master"},
+		{name: "local head", want: first, wantRef: "refs/heads/master"},
+		{name: "remote branch first", rev: "master", remote: true, want: second, wantRef: "refs/remotes/origin/master"},
+		{name: "local branch", rev: "master", want: first, wantRef: "refs/heads/master"},
+		{name: "remote head expression", rev: "HEAD~1", remote: true, want: first, wantRef: "refs/remotes/origin/master"},
+		{name: "remote branch expression", rev: "master~1", remote: true, want: first, wantRef: "refs/remotes/origin/master"},
+		{name: "local head expression", rev: "HEAD~1", notFound: true},
+		{name: "remote-tracking branch", rev: "origin/master", want: second, wantRef: "refs/remotes/origin/master"},
+		{name: "only remote branch", rev: "feature", remote: true, want: second, wantRef: "refs/remotes/origin/feature"},
+		{name: "only remote branch in local repository", rev: "feature", notFound: true},
+		{name: "only local branch", rev: "dev", remote: true, want: first, wantRef: "refs/heads/dev"},
+		{name: "tag", rev: "v1", remote: true, want: first, wantRef: "refs/tags/v1"},
+		{name: "abbreviated hash", rev: second.String()[:7], remote: true, want: second},
+		{name: "full hash", rev: first.String(), remote: true, want: first},
+		{name: "unknown", rev: "nope", remote: true, notFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, info, err := resolveRevision(r, tt.rev, tt.remote)
+			if tt.notFound {
+				if errors.Cause(err) != ErrRevisionNotFound {
+					t.Fatalf("got %v, want ErrRevisionNotFound", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Hash != tt.want {
+				t.Errorf("got %s, want %s", c.Hash, tt.want)
+			}
+			if info.Ref != tt.wantRef {
+				t.Errorf("got ref %q, want %q", info.Ref, tt.wantRef)
+			}
+			if info.Revision != tt.rev {
+				t.Errorf("got revision %q, want %q", info.Revision, tt.rev)
+			}
+		})
+	}
+}
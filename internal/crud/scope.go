@@ -0,0 +1,200 @@
+package crud
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// ErrDirectoryNotFound is used when an included directory doesn't exist in a scanned commit or working tree.
+var ErrDirectoryNotFound = errors.New("directory not found")
+
+// SplitDirs splits a comma separated list of directories, e.g: "app, k8s", empty items are dropped.
+func SplitDirs(s string) []string {
+	var dirs []string
+	for _, d := range strings.Split(s, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+
+	return dirs
+}
+
+// cleanDirs normalizes directories to slash separated paths relative to a repository root,
+// e.g: /app/ and ./app are app. A root directory is dropped, since it means the whole repository.
+func cleanDirs(dirs []string) ([]string, error) {
+	var op = "crud.cleanDirs"
+
+	var clean []string
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		d = strings.Trim(path.Clean(strings.ReplaceAll(d, "\\", "/")), "/")
+		if d == ".." || strings.HasPrefix(d, "../") {
+			return nil, errors.Errorf("(%s): directory %s is outside of a repository", op, d)
+		} else if d == "" || d == "." || seen[d] {
+			continue
+		}
+
+		seen[d] = true
+		clean = append(clean, d)
+	}
+
+	return clean, nil
+}
+
+// inDir returns true if a file name is inside dir, or is dir itself.
+func inDir(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// inDirs returns true if a file name is inside any of dirs.
+func inDirs(name string, dirs []string) bool {
+	for _, d := range dirs {
+		if inDir(name, d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scopeFiles returns files that are inside include directories, or all of them if include is empty,
+// and aren't inside exclude directories. A file is returned once even if include directories overlap.
+// It fails with ErrDirectoryNotFound if some include directory doesn't have any files.
+func scopeFiles(files []sourceFile, include, exclude []string) ([]sourceFile, error) {
+	var op = "crud.scopeFiles"
+
+	found := make(map[string]bool, len(include))
+	seen := make(map[string]bool, len(files))
+	scoped := make([]sourceFile, 0, len(files))
+	for _, f := range files {
+		if seen[f.Name] {
+			continue
+		}
+
+		if len(include) > 0 {
+			var ok bool
+			for _, d := range include {
+				if inDir(f.Name, d) {
+					found[d], ok = true, true
+				}
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		if inDirs(f.Name, exclude) {
+			continue
+		}
+
+		seen[f.Name] = true
+		scoped = append(scoped, f)
+	}
+
+	for _, d := range include {
+		if !found[d] {
+			return nil, errors.Wrapf(ErrDirectoryNotFound, "(%s): %s", op, d)
+		}
+	}
+
+	return scoped, nil
+}
+
+// subtreeFiles returns files of include subtrees of a commit tree, or of the whole tree if include is empty,
+// so files outside of them aren't even listed, except .gitattributes files of their parent directories,
+// since they apply to files in subtrees too, a filter config of a repository, and modules and data
+// of it's policyDir. Names of files stay relative to a repository root. Content of files is read from blobs.
+func subtreeFiles(ctx context.Context, blobs *blobReaders, tree *object.Tree, include []string, policyDir string) ([]sourceFile, error) {
+	var op = "crud.subtreeFiles"
+
+	if len(include) == 0 {
+		return treeFiles(ctx, tree, "", blobs)
+	}
+
+	var files []sourceFile
+	seen := make(map[string]bool)
+	for _, d := range include {
+		sub, err := tree.Tree(d)
+		if err == object.ErrDirectoryNotFound {
+			return nil, errors.Wrapf(ErrDirectoryNotFound, "(%s): %s", op, d)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "(%s): %s", op, d)
+		}
+
+		subFiles, err := treeFiles(ctx, sub, d+"/", blobs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): %s", op, d)
+		}
+		files = append(files, subFiles...)
+
+		for parent := path.Dir(d); ; parent = path.Dir(parent) {
+			if name := path.Join(parent, gitattributesFile); !seen[name] {
+				seen[name] = true
+				if f, err := tree.File(name); err == nil {
+					files = append(files, treeFile(f, "", blobs))
+				}
+			}
+			if parent == "." {
+				break
+			}
+		}
+	}
+
+	for _, name := range repoConfigFiles {
+		if f, err := tree.File(name); err == nil {
+			files = append(files, treeFile(f, "", blobs))
+		}
+	}
+
+	policyFiles, err := policyDirFiles(ctx, tree, include, policyDir, blobs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): %s", op, policyDir)
+	}
+
+	return append(files, policyFiles...), nil
+}
+
+// policyDirFiles returns modules and data documents of a policy directory, that isn't inside include directories,
+// or of it's part outside of them, if it's a parent of one. If a policy directory is a root of a repository,
+// only modules and documents of include directories are used, so nothing else is listed, it would walk
+// the whole tree that include directories scope a scan to.
+func policyDirFiles(ctx context.Context, tree *object.Tree, include []string, policyDir string, blobs *blobReaders) ([]sourceFile, error) {
+	if policyDir == "" {
+		return nil, nil
+	}
+	for _, d := range include {
+		if inDir(policyDir, d) { // already listed
+			return nil, nil
+		}
+	}
+
+	sub, err := tree.Tree(policyDir)
+	if err == object.ErrDirectoryNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	all, err := treeFiles(ctx, sub, policyDir+"/", blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []sourceFile
+	for _, f := range all {
+		if !(isPolicyModule(f.Name) || isPolicyData(f.Name)) {
+			continue
+		}
+		if inDirs(f.Name, include) { // already listed
+			continue
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,232 @@
+package crud
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCleanDirs(t *testing.T) {
+	tests := []struct {
+		name    string
+		dirs    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "slashes", dirs: []string{"/app/", "./deploy/k8s", "docs//api"}, want: []string{"app", "deploy/k8s", "docs/api"}},
+		{name: "backslashes", dirs: []string{`deploy\k8s`}, want: []string{"deploy/k8s"}},
+		{name: "duplicates", dirs: []string{"app", "app/", "./app"}, want: []string{"app"}},
+		{name: "root", dirs: []string{"/", ".", "", "app/.."}},
+		{name: "inside", dirs: []string{"app/../lib"}, want: []string{"lib"}},
+		{name: "outside", dirs: []string{"../app"}, wantErr: true},
+		{name: "parent", dirs: []string{"app/../.."}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanDirs(tt.dirs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopeFiles(t *testing.T) {
+	var files []sourceFile
+	for _, n := range []string{"app/main.go", "app/vendor/lib.go", "webapp/index.js", "docs/app.md", "README.md"} {
+		files = append(files, sourceFile{Name: n})
+	}
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		want     []string
+		notFound bool
+	}{
+		{name: "all", want: []string{"app/main.go", "app/vendor/lib.go", "webapp/index.js", "docs/app.md", "README.md"}},
+		{name: "include", include: []string{"app"}, want: []string{"app/main.go", "app/vendor/lib.go"}},
+		{name: "overlapping include", include: []string{"app", "app/vendor"}, want: []string{"app/main.go", "app/vendor/lib.go"}},
+		{name: "exclude inside include", include: []string{"app"}, exclude: []string{"app/vendor"}, want: []string{"app/main.go"}},
+		{name: "exclude", exclude: []string{"app", "docs"}, want: []string{"webapp/index.js", "README.md"}},
+		{name: "file", include: []string{"README.md"}, want: []string{"README.md"}},
+		{name: "not found", include: []string{"app", "lib"}, notFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scoped, err := scopeFiles(files, tt.include, tt.exclude)
+			if tt.notFound {
+				if errors.Cause(err) != ErrDirectoryNotFound {
+					t.Fatalf("got %v, want ErrDirectoryNotFound", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sourceNames(scoped, false); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtreeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := commit(t, initRepo(t, dir), map[string]string{
+		".gitattributes":         "*.gen.go linguist-generated\n",
+		".gitfilter.yaml":        "config: [{name: go, glob: ['*.go']}]\n",
+		"app/.gitattributes":     "vendor/** linguist-vendored\n",
+		"app/main.go":            "package main\n",
+		"app/k8s/deploy.yaml":    "kind: Deployment\n",
+		"app/k8s/.gitattributes": "*.yaml linguist-language=YAML\n",
+		"app/policy.rego":        "package app\n",
+		"lib/lib.go":             "package lib\n",
+		"policy/main.rego":       "package main\n",
+		"policy/main_test.rego":  "package main\n",
+		"policy/data.json":       "{}\n",
+		"policy/README.md":       "# Policies\n",
+		"policy/k8s/k8s.rego":    "package k8s\n",
+	})
+	r := pack(t, dir)
+	c, err := r.CommitObject(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := []string{
+		".gitattributes", ".gitfilter.yaml", "app/.gitattributes", "app/k8s/.gitattributes", "app/k8s/deploy.yaml",
+		"app/main.go", "app/policy.rego", "lib/lib.go", "policy/README.md", "policy/data.json", "policy/k8s/k8s.rego",
+		"policy/main.rego", "policy/main_test.rego",
+	}
+
+	tests := []struct {
+		name      string
+		include   []string
+		policyDir string
+		want      []string
+		notFound  bool
+	}{
+		{name: "whole tree", policyDir: "policy", want: all},
+		{name: "whole tree and whole repository policy", want: all},
+		{
+			name:      "include",
+			include:   []string{"lib"},
+			policyDir: "policy",
+			want:      []string{".gitattributes", ".gitfilter.yaml", "lib/lib.go", "policy/data.json", "policy/k8s/k8s.rego", "policy/main.rego"},
+		},
+		{
+			name:      "gitattributes of parents",
+			include:   []string{"app/k8s"},
+			policyDir: "policy",
+			want: []string{
+				".gitattributes", ".gitfilter.yaml", "app/.gitattributes", "app/k8s/.gitattributes", "app/k8s/deploy.yaml",
+				"policy/data.json", "policy/k8s/k8s.rego", "policy/main.rego",
+			},
+		},
+		{
+			name:      "included policy dir",
+			include:   []string{"lib", "policy"},
+			policyDir: "policy",
+			want: []string{
+				".gitattributes", ".gitfilter.yaml", "lib/lib.go", "policy/README.md", "policy/data.json",
+				"policy/k8s/k8s.rego", "policy/main.rego", "policy/main_test.rego",
+			},
+		},
+		{
+			name:      "policy dir inside include",
+			include:   []string{"policy/k8s"},
+			policyDir: "policy",
+			want:      []string{".gitattributes", ".gitfilter.yaml", "policy/data.json", "policy/k8s/k8s.rego", "policy/main.rego"},
+		},
+		{
+			name:      "policy dir is a parent of include",
+			include:   []string{"app/k8s"},
+			policyDir: "app",
+			want:      []string{".gitattributes", ".gitfilter.yaml", "app/.gitattributes", "app/k8s/.gitattributes", "app/k8s/deploy.yaml", "app/policy.rego"},
+		},
+		{
+			name:    "whole repository policy isn't walked",
+			include: []string{"lib"},
+			want:    []string{".gitattributes", ".gitfilter.yaml", "lib/lib.go"},
+		},
+		{name: "missing policy dir", include: []string{"lib"}, policyDir: "rules", want: []string{".gitattributes", ".gitfilter.yaml", "lib/lib.go"}},
+		{name: "missing include", include: []string{"lib", "web"}, policyDir: "policy", notFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := subtreeFiles(context.Background(), newBlobReaders(r), tree, tt.include, tt.policyDir)
+			if tt.notFound {
+				if errors.Cause(err) != ErrDirectoryNotFound {
+					t.Fatalf("got %v, want ErrDirectoryNotFound", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sourceNames(files, true); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyFiles(t *testing.T) {
+	var files []sourceFile
+	for _, n := range []string{"app/app.rego", "lib/lib.rego", "policy/main.rego"} {
+		files = append(files, sourceFile{Name: n})
+	}
+
+	tests := []struct {
+		name      string
+		include   []string
+		policyDir string
+		want      []string
+	}{
+		{name: "whole repository", want: []string{"app/app.rego", "lib/lib.rego", "policy/main.rego"}},
+		{name: "included part of a repository", include: []string{"app", "lib"}, want: []string{"app/app.rego", "lib/lib.rego"}},
+		{name: "policy dir", include: []string{"app"}, policyDir: "policy", want: []string{"app/app.rego", "lib/lib.rego", "policy/main.rego"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sourceNames(policyFiles(files, tt.include, tt.policyDir), false); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// sourceNames returns names of files, sorted if sorted is true.
+func sourceNames(files []sourceFile, sorted bool) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if sorted {
+		sort.Strings(names)
+	}
+
+	return names
+}
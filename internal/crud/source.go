@@ -0,0 +1,416 @@
+package crud
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// SourceMode tells which files of a local repository are scanned.
+type SourceMode string
+
+// Source modes of GetLocalCollectionContext.
+const (
+	SourceCommit   SourceMode = "commit"   // files of a commit, HEAD by default
+	SourceIndex    SourceMode = "index"    // staged files
+	SourceWorktree SourceMode = "worktree" // files on disk with uncommitted changes, ignored files are skipped
+)
+
+// gitignoreFile is a file that holds patterns of ignored files in each directory of a working tree.
+const gitignoreFile = ".gitignore"
+
+// sourceFile is a single file of a commit tree, an index or a working tree,
+// it only holds metadata, content is streamed by open when it's needed.
+type sourceFile struct {
+	Name string            // path relative to a repository root, separated by slashes
+	Hash plumbing.Hash     // blob hash, zero for files on disk, it's computed when they are indexed
+	Size int64             // bytes
+	Mode filemode.FileMode // e.g: 0100644 for a regular file, 0100755 for an executable one
+
+	open func() (io.ReadCloser, error)
+}
+
+// read returns content of a source file.
+func (f sourceFile) read() ([]byte, error) {
+	rc, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// hash computes a blob hash of a source file without keeping it's content in memory.
+func (f sourceFile) hash() (plumbing.Hash, error) {
+	rc, err := f.open()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer rc.Close()
+
+	h := plumbing.NewHasher(plumbing.BlobObject, f.Size)
+	if _, err = io.Copy(h, rc); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return h.Sum(), nil
+}
+
+// ParseSourceMode parses a source mode, empty string means SourceCommit.
+func ParseSourceMode(s string) (SourceMode, error) {
+	var op = "crud.ParseSourceMode"
+
+	switch mode := SourceMode(strings.TrimSpace(s)); mode {
+	case "":
+		return SourceCommit, nil
+	case SourceCommit, SourceIndex, SourceWorktree:
+		return mode, nil
+	}
+
+	return "", errors.Errorf("(%s): unknown source %q, must be commit, index or worktree", op, s)
+}
+
+// GetLocalCollection returns a filled GitCollection of a local repository at path without cloning it,
+// path can be any directory inside a working tree.
+func GetLocalCollection(path, rev, dir string, source SourceMode) (*GitCollection, error) {
+	return GetLocalCollectionContext(context.Background(), path, rev, dir, &Options{Source: source})
+}
+
+// GetLocalCollectionContext is the same as GetLocalCollection, but it can be canceled by ctx,
+// and reports it's progress to opts.Progress. opts.Source tells if files are read from a commit,
+// which is rev or HEAD if it's empty, from an index or from a working tree. rev is ignored by the last two.
+// If dir and opts.Include are empty and path is a sub directory of a working tree, only that sub directory is scanned.
+func GetLocalCollectionContext(ctx context.Context, path, rev, dir string, opts *Options) (*GitCollection, error) {
+	var op = "crud.GetLocalCollection"
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	source, err := ParseSourceMode(string(opts.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): resolving a path", op)
+	}
+
+	opts.Progress.report(StageCloning, 0)
+	r, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): opening a git repo", op)
+	}
+	opts.Progress.report(StageCloning, 100)
+
+	root := path
+	if wt, err := r.Worktree(); err == nil {
+		root = wt.Filesystem.Root()
+	} else if source != SourceCommit {
+		return nil, errors.Wrapf(err, "(%s): %s can only be read from a repository with a working tree", op, source)
+	}
+
+	include := opts.Include
+	if dir != "" {
+		include = append([]string{dir}, include...)
+	} else if len(include) == 0 && root != path {
+		if rel, err := filepath.Rel(root, path); err == nil {
+			include = []string{filepath.ToSlash(rel)}
+		}
+	}
+	include, err = cleanDirs(include)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): parsing included directories", op)
+	}
+	exclude, err := cleanDirs(opts.Exclude)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): parsing excluded directories", op)
+	}
+
+	coll := &GitCollection{
+		BaseURL: "file://" + filepath.ToSlash(root),
+		Source:  source,
+	}
+
+	// a commit that index and working tree are based on is reported too, a new repository doesn't have it
+	commit, info, err := resolveRevision(r, rev, false)
+	if source == SourceCommit || rev != "" {
+		if err != nil {
+			return nil, errors.Wrapf(err, "(%s): resolving a revision", op)
+		}
+	}
+	if err == nil {
+		coll.BaseHash = info.Hash
+		coll.Commit = info
+	}
+
+	var files []sourceFile
+	switch source {
+	case SourceCommit:
+		var tree *object.Tree
+		if tree, err = commit.Tree(); err != nil {
+			return nil, errors.Wrapf(err, "(%s): retrieving a commit file structure", op)
+		}
+		files, err = subtreeFiles(ctx, newBlobReaders(r), tree, include, opts.policyDir())
+	case SourceIndex:
+		files, err = indexFiles(r)
+	case SourceWorktree:
+		files, err = worktreeFiles(ctx, root)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "(%s): listing %s files", op, source)
+	}
+
+	blobURL := func(name string) string {
+		return coll.BaseURL + "/" + name
+	}
+	if err = coll.index(ctx, files, include, exclude, blobURL, opts); err != nil {
+		return nil, errors.Wrapf(err, "(%s): retrieving list of files", op)
+	}
+
+	return coll, nil
+}
+
+// treeFiles returns all files of a commit tree, prefix is prepended to their names, so names of files
+// in a subtree are relative to a repository root. A tree is walked serially, and content of files
+// is read from blobs, see blobReaders.
+func treeFiles(ctx context.Context, tree *object.Tree, prefix string, blobs *blobReaders) ([]sourceFile, error) {
+	var files []sourceFile
+	err := tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, treeFile(f, prefix, blobs))
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// treeFile returns a source file of a commit tree file, prefix is prepended to it's name.
+func treeFile(f *object.File, prefix string, blobs *blobReaders) sourceFile {
+	return sourceFile{
+		Name: prefix + f.Name,
+		Hash: f.Hash,
+		Size: f.Blob.Size,
+		Mode: f.Mode,
+		open: blobs.opener(f.Hash),
+	}
+}
+
+// blobReaders reads blobs of a repository on several goroutines at once. Object storage of go-git loads
+// indexes of packfiles on the first lookup and caches objects it reads, so it isn't safe for concurrent use.
+// Each open blob gets it's own storage of the same repository instead, it's put back to a pool when
+// a blob is closed, so there are as many storages as blobs that were read at once, and content is streamed.
+type blobReaders struct {
+	newStorer func() storer.EncodedObjectStorer
+
+	mu   sync.Mutex
+	free []storer.EncodedObjectStorer
+}
+
+// newBlobReaders returns readers of blobs of a repository. Storages in memory only read maps
+// and byte slices, so they are safe for concurrent reads and are shared as they are.
+func newBlobReaders(r *git.Repository) *blobReaders {
+	s, ok := r.Storer.(*filesystem.Storage)
+	if !ok {
+		return &blobReaders{newStorer: func() storer.EncodedObjectStorer { return r.Storer }}
+	}
+
+	fs := s.Filesystem()
+	return &blobReaders{newStorer: func() storer.EncodedObjectStorer {
+		return filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+	}}
+}
+
+// get takes a free storage from the pool, or makes a new one if all of them are in use.
+func (b *blobReaders) get() storer.EncodedObjectStorer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n := len(b.free); n > 0 {
+		s := b.free[n-1]
+		b.free = b.free[:n-1]
+		return s
+	}
+
+	return b.newStorer()
+}
+
+// put returns a storage to the pool.
+func (b *blobReaders) put(s storer.EncodedObjectStorer) {
+	b.mu.Lock()
+	b.free = append(b.free, s)
+	b.mu.Unlock()
+}
+
+// opener returns a function that opens a blob with hash, a storage it's read from is kept until it's closed.
+func (b *blobReaders) opener(hash plumbing.Hash) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		s := b.get()
+
+		obj, err := s.EncodedObject(plumbing.BlobObject, hash)
+		if err != nil {
+			b.put(s)
+			return nil, err
+		}
+		rc, err := obj.Reader()
+		if err != nil {
+			b.put(s)
+			return nil, err
+		}
+
+		return &blobReader{ReadCloser: rc, release: func() { b.put(s) }}, nil
+	}
+}
+
+// blobReader is content of a blob, it puts it's storage back to the pool once it's closed.
+type blobReader struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *blobReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+
+	return err
+}
+
+// indexFiles returns all staged files of a repository, submodules are skipped like in a commit tree.
+func indexFiles(r *git.Repository) ([]sourceFile, error) {
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := newBlobReaders(r)
+
+	files := make([]sourceFile, 0, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if e.Mode == filemode.Submodule || e.Stage != 0 { // unmerged entries are reported by git as conflicts, not files
+			continue
+		}
+
+		files = append(files, sourceFile{
+			Name: e.Name,
+			Hash: e.Hash,
+			Size: int64(e.Size),
+			Mode: e.Mode,
+			open: blobs.opener(e.Hash),
+		})
+	}
+
+	return files, nil
+}
+
+// worktreeFiles returns all files on disk of a working tree in root, including untracked ones.
+// Files ignored by .gitignore files, .git/info/exclude and global excludes file are skipped like git does.
+func worktreeFiles(ctx context.Context, root string) ([]sourceFile, error) {
+	var files []sourceFile
+
+	patterns, _ := gitignore.LoadGlobalPatterns(osfs.New(string(filepath.Separator)))
+	exclude, _ := readIgnoreFile(filepath.Join(root, git.GitDirName, "info", "exclude"), nil)
+	patterns = append(patterns, exclude...)
+
+	var walk func(path []string) error
+	walk = func(path []string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		dir := filepath.Join(append([]string{root}, path...)...)
+
+		// patterns of a directory only match files inside it, so they can be kept for it's siblings
+		ps, err := readIgnoreFile(filepath.Join(dir, gitignoreFile), path)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, ps...)
+		matcher := gitignore.NewMatcher(patterns)
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if info.Name() == git.GitDirName {
+				continue
+			}
+
+			name := append(append([]string{}, path...), info.Name())
+			if matcher.Match(name, info.IsDir()) {
+				continue
+			}
+
+			if info.IsDir() {
+				if err = walk(name); err != nil {
+					return err
+				}
+			} else if info.Mode().IsRegular() {
+				full := filepath.Join(dir, info.Name())
+				mode, err := filemode.NewFromOSFileMode(info.Mode())
+				if err != nil {
+					return err
+				}
+
+				files = append(files, sourceFile{
+					Name: strings.Join(name, "/"),
+					Size: info.Size(),
+					Mode: mode,
+					open: func() (io.ReadCloser, error) {
+						return os.Open(full)
+					},
+				})
+			}
+		}
+
+		return nil
+	}
+
+	return files, walk(nil)
+}
+
+// readIgnoreFile reads gitignore patterns from a file, domain is a path of a directory they apply to.
+// A missing file has no patterns.
+func readIgnoreFile(path string, domain []string) ([]gitignore.Pattern, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ps []gitignore.Pattern
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, domain))
+	}
+
+	return ps, s.Err()
+}
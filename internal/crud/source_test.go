@@ -0,0 +1,222 @@
+package crud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// TestParallelIndex checks that workers read blobs from object storage at the same time,
+// and that a parallel run returns the same files as a serial one.
+func TestParallelIndex(t *testing.T) {
+	const workers = 4
+
+	dir, err := ioutil.TempDir("", "crud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := commitFiles(t, dir, 4*workers)
+
+	index := func(blobs *blobReaders, workers int) string {
+		files, err := treeFiles(context.Background(), tree, "", blobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coll, _, _, err := retrieveFiles(context.Background(), files, func(name string) string { return name },
+			DefaultMaxBlobSize, nil, workers, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b strings.Builder
+		for _, f := range coll {
+			fmt.Fprintf(&b, "%s %s %s %d\n", f.Name, f.Hash, f.Extension, f.lines)
+		}
+		return b.String()
+	}
+
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := index(newBlobReaders(r), 1)
+
+	// the first reads of workers wait until all of them are in the middle of reading,
+	// they would time out if storage were read by a single worker at once
+	b := &readBarrier{n: workers, all: make(chan struct{})}
+	blobs := newBlobReaders(r)
+	newStorer := blobs.newStorer
+	blobs.newStorer = func() storer.EncodedObjectStorer {
+		return barrierStorer{EncodedObjectStorer: newStorer(), barrier: b}
+	}
+	par := index(blobs, workers)
+
+	if b.timedOut {
+		t.Errorf("%d workers didn't read blobs at the same time", workers)
+	}
+	if serial != par {
+		t.Errorf("parallel indexing returned different files than serial one:\n%s\nwant:\n%s", par, serial)
+	}
+}
+
+// commitFiles commits count files to a new repository in dir, and returns a tree of the commit.
+func commitFiles(t *testing.T, dir string, count int) *object.Tree {
+	files := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		files[fmt.Sprintf("file%d.go", i)] = fmt.Sprintf("package main\n\nfunc f%d() {}\n", i)
+	}
+
+	h := commit(t, initRepo(t, dir), files)
+	c, err := pack(t, dir).CommitObject(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+// initRepo creates a new repository with a working tree in dir.
+func initRepo(t *testing.T, dir string) *git.Repository {
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// commit writes files to a working tree of a repository and commits them,
+// files are added to ones of previous commits.
+func commit(t *testing.T, r *git.Repository, files map[string]string) plumbing.Hash {
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(wt.Filesystem.Root(), filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	h, err := wt.Commit("files", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+// pack packs objects of a repository in dir like in a cloned repository, and opens it again,
+// since storage of a repository that packed them keeps indexes of packfiles it removed.
+func pack(t *testing.T, dir string) *git.Repository {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.RepackObjects(&git.RepackConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = git.PlainOpen(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// readBarrier holds the first reads of n blobs until all of them have started.
+type readBarrier struct {
+	n   int
+	all chan struct{}
+
+	mu       sync.Mutex
+	started  int
+	timedOut bool
+}
+
+func (b *readBarrier) wait() {
+	b.mu.Lock()
+	b.started++
+	if b.started > b.n {
+		b.mu.Unlock()
+		return
+	} else if b.started == b.n {
+		close(b.all)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.all:
+	case <-time.After(5 * time.Second):
+		b.mu.Lock()
+		b.timedOut = true
+		b.mu.Unlock()
+	}
+}
+
+// barrierStorer is object storage which blob readers wait for a barrier before their first read.
+type barrierStorer struct {
+	storer.EncodedObjectStorer
+	barrier *readBarrier
+}
+
+func (s barrierStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.EncodedObjectStorer.EncodedObject(t, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return barrierObject{EncodedObject: obj, barrier: s.barrier}, nil
+}
+
+type barrierObject struct {
+	plumbing.EncodedObject
+	barrier *readBarrier
+}
+
+func (o barrierObject) Reader() (io.ReadCloser, error) {
+	rc, err := o.EncodedObject.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	return &barrierReader{ReadCloser: rc, barrier: o.barrier}, nil
+}
+
+type barrierReader struct {
+	io.ReadCloser
+	barrier *readBarrier
+	once    sync.Once
+}
+
+func (r *barrierReader) Read(p []byte) (int, error) {
+	r.once.Do(r.barrier.wait)
+
+	return r.ReadCloser.Read(p)
+}
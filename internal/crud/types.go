@@ -0,0 +1,117 @@
+package crud
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FileType is a built-in detector of a kind of config files, a Config can use it by it's name
+// instead of writing it's own filter, e.g: "type": "kubernetes".
+type FileType struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	Glob    []string        `json:"glob"`              // patterns of file names, like Config.Glob
+	Exclude []string        `json:"exclude,omitempty"` // patterns of files that are never of this type
+	Content *ContentMatcher `json:"content,omitempty"` // content files of this type must have, if names aren't enough
+}
+
+// fileTypes is a catalog of built-in file types, sorted by name.
+var fileTypes = []FileType{
+	{
+		Name:        "ansible",
+		Description: "Ansible playbooks and role tasks",
+		Glob:        []string{"playbook*.yml", "playbook*.yaml", "site.yml", "site.yaml", "roles/**/*.yml", "roles/**/*.yaml", "playbooks/**/*.yml", "playbooks/**/*.yaml"},
+		Content:     &ContentMatcher{Regexp: `(?m)^-\s+(hosts|name|import_playbook|import_tasks|include_tasks|include_role):`},
+	},
+	{
+		Name:        "cloudformation",
+		Description: "AWS CloudFormation templates in yaml or json",
+		Glob:        []string{"*.yaml", "*.yml", "*.json"},
+		Exclude:     []string{"node_modules/"},
+		Content:     &ContentMatcher{Regexp: `AWS::\w+::\w+`, Keys: []string{"Resources"}},
+	},
+	{
+		Name:        "docker-compose",
+		Description: "Docker Compose files",
+		Glob:        []string{"docker-compose.yml", "docker-compose.yaml", "docker-compose.*.yml", "docker-compose.*.yaml", "compose.yml", "compose.yaml"},
+	},
+	{
+		Name:        "github-actions",
+		Description: "GitHub Actions workflows",
+		Glob:        []string{"/.github/workflows/*.yml", "/.github/workflows/*.yaml"},
+		Content:     &ContentMatcher{Keys: []string{"jobs"}},
+	},
+	{
+		Name:        "gitlab-ci",
+		Description: "GitLab CI pipelines",
+		Glob:        []string{".gitlab-ci.yml", "*.gitlab-ci.yml"},
+	},
+	{
+		Name:        "helm",
+		Description: "Helm charts, only Chart.yaml of each chart",
+		Glob:        []string{"Chart.yaml"},
+		Content:     &ContentMatcher{Keys: []string{"name", "version"}},
+	},
+	{
+		Name:        "kubernetes",
+		Description: "Kubernetes manifests in yaml or json, helm templates aren't valid yaml, so they don't match",
+		Glob:        []string{"*.yaml", "*.yml", "*.json"},
+		Exclude:     []string{"node_modules/"},
+		Content:     &ContentMatcher{Keys: []string{"apiVersion", "kind", "metadata"}},
+	},
+	{
+		Name:        "kustomize",
+		Description: "Kustomize kustomization files",
+		Glob:        []string{"kustomization.yaml", "kustomization.yml", "Kustomization"},
+	},
+	{
+		Name:        "terraform",
+		Description: "Terraform configurations in hcl or json",
+		Glob:        []string{"*.tf", "*.tf.json"},
+		Exclude:     []string{".terraform/"},
+	},
+}
+
+// FileTypes returns all built-in file types, sorted by name.
+func FileTypes() []FileType {
+	return append([]FileType{}, fileTypes...)
+}
+
+// fileType returns a built-in file type by it's name.
+func fileType(name string) (FileType, error) {
+	var op = "crud.fileType"
+
+	names := make([]string, len(fileTypes))
+	for i, t := range fileTypes {
+		if t.Name == name {
+			return t, nil
+		}
+		names[i] = t.Name
+	}
+
+	return FileType{}, errors.Errorf("(%s): unknown type %q, must be one of %s", op, name, strings.Join(names, ", "))
+}
+
+// withType returns a config that matches files of it's type, patterns and content of a type are copied into it.
+// A type can't be combined with it's own filter, glob or content, but exclude patterns are added to ones of a type.
+func (c Config) withType() (Config, error) {
+	if c.Type == "" {
+		return c, nil
+	}
+
+	t, err := fileType(c.Type)
+	if err != nil {
+		return c, err
+	}
+	if c.Filter != "" || len(c.Glob) > 0 || !c.Content.empty() || c.Match != "" {
+		return c, errors.New("type can't be combined with filter, glob, content or match")
+	}
+
+	c.Glob = t.Glob
+	c.Content = t.Content
+	c.Exclude = append(append([]string{}, t.Exclude...), c.Exclude...)
+
+	return c, nil
+}
@@ -0,0 +1,177 @@
+package crud
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultNamespace is a package of a policy deny, warn and violation rules are evaluated in, if a config doesn't set one.
+const DefaultNamespace = "main"
+
+// Kinds of policy rules, deny and violation fail a file, warn only warns about it.
+const (
+	KindDeny      = "deny"
+	KindViolation = "violation"
+	KindWarn      = "warn"
+)
+
+// policyKinds are policy rules that are evaluated, in order their messages are reported.
+var policyKinds = []string{KindDeny, KindViolation, KindWarn}
+
+// Verdicts of files and collections, from the best to the worst.
+const (
+	VerdictPass = "pass" // a policy didn't return any messages
+	VerdictWarn = "warn" // a policy returned only warnings
+	VerdictFail = "fail" // a policy denied a file
+)
+
+// verdictRank orders verdicts, a collection has the worst verdict of it's files.
+var verdictRank = map[string]int{"": 0, VerdictPass: 1, VerdictWarn: 2, VerdictFail: 3}
+
+// worseVerdict returns the worse of two verdicts, an empty verdict is the best one.
+func worseVerdict(a, b string) string {
+	if verdictRank[b] > verdictRank[a] {
+		return b
+	}
+
+	return a
+}
+
+// namespaceRegexp matches a rego package name, e.g: main or kubernetes.admission.
+var namespaceRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// validateNamespace returns an error if a namespace isn't a valid package name, an empty one is DefaultNamespace.
+func validateNamespace(ns string) error {
+	if ns != "" && !namespaceRegexp.MatchString(ns) {
+		return errors.Errorf("invalid namespace %q, must be a package name, e.g: main or kubernetes.admission", ns)
+	}
+
+	return nil
+}
+
+// Severities of findings, a policy can set it's own in a severity field of an object, e.g: critical.
+const (
+	SeverityError   = "error"   // default severity of deny and violation findings
+	SeverityWarning = "warning" // default severity of warn findings
+)
+
+// Finding is a message returned by a deny, warn or violation rule of a policy. A rule can return strings
+// or objects, a message of an object is read from it's msg field, severity, resource and remediation fields
+// are read too, and other fields are kept in Metadata.
+type Finding struct {
+	Rule     string `json:"rule"`     // name of a config whose policy returned a finding
+	Kind     string `json:"kind"`     // deny, violation or warn
+	Severity string `json:"severity"` // e.g: error, warning
+	Message  string `json:"message"`
+
+	Resource    string                 `json:"resource,omitempty"`    // address of a resource in a file, e.g: aws_s3_bucket.logs
+	Remediation string                 `json:"remediation,omitempty"` // how to fix a finding, usually a link
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// String returns a finding with it's kind, e.g: deny: containers must not run as root.
+func (f Finding) String() string {
+	return f.Kind + ": " + f.Message
+}
+
+// policyFindings returns findings of deny, violation and warn rules of a package document,
+// a rule that isn't defined doesn't return findings.
+func policyFindings(rule string, doc map[string]interface{}) ([]Finding, error) {
+	var findings []Finding
+	for _, kind := range policyKinds {
+		v, ok := doc[kind]
+		if !ok {
+			continue
+		}
+
+		switch v := v.(type) {
+		case []interface{}: // a set or an array of messages
+			for _, item := range v {
+				f, err := newFinding(kind, item)
+				if err != nil {
+					return nil, err
+				}
+				f.Rule = rule
+				findings = append(findings, f)
+			}
+		case bool: // a boolean rule, e.g: deny { input.kind == "Pod" }
+			if v {
+				findings = append(findings, Finding{Rule: rule, Kind: kind, Severity: kindSeverity(kind), Message: kind})
+			}
+		default:
+			return nil, errors.Errorf("%s rule must be a set of messages, it's %T", kind, v)
+		}
+	}
+
+	return findings, nil
+}
+
+// kindSeverity returns a default severity of findings of a kind.
+func kindSeverity(kind string) string {
+	if kind == KindWarn {
+		return SeverityWarning
+	}
+
+	return SeverityError
+}
+
+// newFinding converts an item of a deny, violation or warn set into a finding.
+func newFinding(kind string, item interface{}) (Finding, error) {
+	f := Finding{Kind: kind, Severity: kindSeverity(kind)}
+
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		if s, ok := item.(string); ok {
+			f.Message = s
+		} else {
+			f.Message = fmt.Sprint(item)
+		}
+		return f, nil
+	}
+
+	f.Metadata = make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		s, isString := v.(string)
+		switch {
+		case k == "msg" && isString:
+			f.Message = s
+		case k == "severity" && isString:
+			f.Severity = s
+		case k == "resource" && isString:
+			f.Resource = s
+		case k == "remediation" && isString:
+			f.Remediation = s
+		default:
+			f.Metadata[k] = v
+		}
+	}
+	if len(f.Metadata) == 0 {
+		f.Metadata = nil
+	}
+
+	if f.Message == "" { // an object without a message is reported as a whole
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return f, errors.Wrapf(err, "encoding a message of %s rule", kind)
+		}
+		f.Message = string(b)
+	}
+
+	return f, nil
+}
+
+// findingsVerdict returns a verdict of a file by findings of a policy.
+func findingsVerdict(findings []Finding) string {
+	verdict := VerdictPass
+	for _, f := range findings {
+		if f.Kind == KindWarn {
+			verdict = worseVerdict(verdict, VerdictWarn)
+		} else {
+			verdict = VerdictFail
+		}
+	}
+
+	return verdict
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"math/rand"
 	"time"
 )
@@ -24,3 +26,14 @@ func randomStringWithCharset(length int, charset string) string {
 func RandomString(length int) string {
 	return randomStringWithCharset(length, charset)
 }
+
+// RandomToken generates a hex encoded string from n cryptographically secure random bytes,
+// it's used for ids that mustn't be guessed, e.g: session ids.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
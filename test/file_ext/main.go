@@ -3,7 +3,7 @@ package main
 import (
 	"fmt"
 
-	enry "github.com/src-d/enry/v2"
+	enry "github.com/go-enry/go-enry/v2"
 )
 
 func main() {
@@ -0,0 +1,259 @@
+// Package index_bench compares serial and parallel indexing of a generated repository, e.g:
+// go test -bench . ./test/index_bench -args -files 20000 -workers 8
+package index_bench
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bejaneps/go-git-webapp/internal/crud"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+var (
+	files   = flag.Int("files", 2000, "count of files in a generated repository")
+	width   = flag.Int("width", 10, "count of sub directories in each directory of a generated repository")
+	workers = flag.Int("workers", 4, "count of goroutines of a parallel run, more than 1 so the race detector sees them")
+)
+
+// samples are contents of generated files by extension, some of them need content to detect a language.
+var samples = map[string]string{
+	".go":   "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(%d)\n}\n",
+	".yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config-%d\n",
+	".md":   "# Document %d\n\nSome text.\n",
+	".json": "{\"id\": %d}\n",
+	".h":    "#ifndef H_%d\n#define H_%d\nint f(void);\n#endif\n",
+	"":      "#!/bin/sh\necho %d\n",
+}
+
+// repoDir is a generated repository all tests and benchmarks index.
+var repoDir string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	dir, err := ioutil.TempDir("", "index_bench")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	if err = generate(dir, *files, *width); err != nil {
+		os.RemoveAll(dir)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if testing.Verbose() {
+		fmt.Printf("generated %d files in %s\n", *files, time.Since(start).Round(time.Millisecond))
+	}
+	repoDir = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// TestParallelIndex checks that a parallel run returns the same files as a serial one.
+func TestParallelIndex(t *testing.T) {
+	serial, err := index(repoDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serial.Close()
+
+	par, err := index(repoDir, *workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer par.Close()
+
+	if a, b := summary(serial), summary(par); a != b {
+		t.Fatal("parallel indexing returned different files than serial one")
+	}
+}
+
+// BenchmarkIndex indexes a generated repository serially and with -workers goroutines.
+func BenchmarkIndex(b *testing.B) {
+	for _, w := range []int{1, *workers} {
+		w := w
+		b.Run(fmt.Sprintf("workers=%d", w), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				coll, err := index(repoDir, w)
+				if err != nil {
+					b.Fatal(err)
+				}
+				coll.Close()
+			}
+		})
+	}
+}
+
+// index indexes a generated repository with a count of workers.
+func index(dir string, workers int) (*crud.GitCollection, error) {
+	return crud.GetLocalCollectionContext(context.Background(), dir, "", "", &crud.Options{Workers: workers})
+}
+
+// summary returns names, hashes and languages of files in order, and language stats of a collection.
+func summary(coll *crud.GitCollection) string {
+	var b strings.Builder
+	for _, f := range coll.Coll {
+		fmt.Fprintf(&b, "%s %s %s %v\n", f.Name, f.Hash, f.Extension, f.Attributes)
+	}
+	fmt.Fprintf(&b, "%+v\n", coll.Language.Stats)
+
+	return b.String()
+}
+
+// generate creates a repository in dir with a single commit of count files, spread over directories
+// that have width sub directories each. Objects are written directly and packed like in a cloned repository,
+// files aren't checked out, since only the commit is indexed.
+func generate(dir string, count, width int) error {
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		return err
+	}
+
+	exts := make([]string, 0, len(samples))
+	for ext := range samples {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	root := &treeNode{}
+	for i := 0; i < count; i++ {
+		ext := exts[i%len(exts)]
+		content := strings.Replace(samples[ext], "%d", fmt.Sprint(i), -1)
+
+		h, err := writeBlob(r.Storer, []byte(content))
+		if err != nil {
+			return err
+		}
+
+		path := []string{fmt.Sprintf("d%d", i%width), fmt.Sprintf("d%d", i/width%width), fmt.Sprintf("file%d%s", i, ext)}
+		root.add(path, h)
+	}
+
+	tree, err := root.write(r.Storer)
+	if err != nil {
+		return err
+	}
+
+	sig := object.Signature{Name: "bench", Email: "bench@example.com", When: time.Now()}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "generated", TreeHash: tree}
+	obj := r.Storer.NewEncodedObject()
+	if err = commit.Encode(obj); err != nil {
+		return err
+	}
+	h, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+	if err = r.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, h)); err != nil {
+		return err
+	}
+
+	// loose objects are read before packed ones, so they are removed after packing
+	if err = r.RepackObjects(&git.RepackConfig{}); err != nil {
+		return err
+	}
+	loose, _ := filepath.Glob(filepath.Join(dir, git.GitDirName, "objects", "[0-9a-f][0-9a-f]"))
+	for _, d := range loose {
+		if err = os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// treeNode is a directory of a generated repository.
+type treeNode struct {
+	files map[string]plumbing.Hash
+	dirs  map[string]*treeNode
+}
+
+// add adds a blob to a directory at path.
+func (n *treeNode) add(path []string, h plumbing.Hash) {
+	if len(path) == 1 {
+		if n.files == nil {
+			n.files = make(map[string]plumbing.Hash)
+		}
+		n.files[path[0]] = h
+		return
+	}
+
+	if n.dirs == nil {
+		n.dirs = make(map[string]*treeNode)
+	}
+	sub, ok := n.dirs[path[0]]
+	if !ok {
+		sub = &treeNode{}
+		n.dirs[path[0]] = sub
+	}
+	sub.add(path[1:], h)
+}
+
+// write writes a directory and all it's sub directories as tree objects, and returns a hash of it's tree.
+func (n *treeNode) write(s storer.EncodedObjectStorer) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	for name, h := range n.files {
+		entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: h})
+	}
+	for name, sub := range n.dirs {
+		h, err := sub.write(s)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: h})
+	}
+
+	// git sorts entries as if directories had a trailing slash
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.SetEncodedObject(obj)
+}
+
+// writeBlob writes content as a blob object.
+func writeBlob(s storer.EncodedObjectStorer, content []byte) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err = w.Write(content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err = w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.SetEncodedObject(obj)
+}